@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dustin/statcap/statstore"
+)
+
+var alertsFile *string = flag.String("alerts", "",
+	"JSON file of alert rules evaluated against each sample")
+
+// A duration that can be read from JSON as "30s" or as nanoseconds.
+type jsonDuration time.Duration
+
+func (d *jsonDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(b, &n); err != nil {
+			return err
+		}
+		*d = jsonDuration(n)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	*d = jsonDuration(v)
+	return err
+}
+
+// A single threshold rule.
+//
+// Stat is a dotted path into a sample (e.g. "all.evictions").  The
+// value found there (or its per-second rate, or its change since the
+// previous sample, depending on Mode) is compared with Op against
+// Value.  If Relative names another stat path, the threshold is
+// Value times that stat, so "curr_connections > 0.9 * max_conns" is
+// expressible.  The condition must hold for For before the rule
+// fires.
+type alertRule struct {
+	Name     string       `json:"name"`
+	Stat     string       `json:"stat"`
+	Mode     string       `json:"mode"`
+	Op       string       `json:"op"`
+	Value    float64      `json:"value"`
+	Relative string       `json:"relative"`
+	For      jsonDuration `json:"for"`
+	Actions  []string     `json:"actions"`
+	Webhook  string       `json:"webhook"`
+
+	// Evaluation state.
+	prev     float64
+	prevTS   time.Time
+	havePrev bool
+	since    time.Time
+	firing   bool
+}
+
+// An alert, as logged, stored and posted.
+type alert struct {
+	Type      string    `json:"type"`
+	TS        time.Time `json:"ts"`
+	Rule      string    `json:"rule"`
+	State     string    `json:"state"`
+	Stat      string    `json:"stat"`
+	Mode      string    `json:"mode,omitempty"`
+	Observed  float64   `json:"observed"`
+	Op        string    `json:"op"`
+	Threshold float64   `json:"threshold"`
+}
+
+func (a alert) String() string {
+	return fmt.Sprintf("alert %v %v: %v %v=%v %v %v",
+		a.Rule, a.State, a.Stat, a.modeName(), a.Observed,
+		a.Op, a.Threshold)
+}
+
+func (a alert) modeName() string {
+	if a.Mode == "" {
+		return "value"
+	}
+	return a.Mode
+}
+
+type alerter struct {
+	rules []*alertRule
+	db    statstore.Storer
+	proto map[string]interface{}
+	// Where webhook alerts go; replaceable for testing.
+	post func(url string, a alert) error
+}
+
+func compare(op string, a, b float64) (bool, error) {
+	switch op {
+	case ">":
+		return a > b, nil
+	case ">=":
+		return a >= b, nil
+	case "<":
+		return a < b, nil
+	case "<=":
+		return a <= b, nil
+	case "==":
+		return a == b, nil
+	case "!=":
+		return a != b, nil
+	}
+	return false, fmt.Errorf("invalid operator: %q", op)
+}
+
+// Find a numeric value at a dotted path in a sample.
+func lookupStat(m map[string]interface{}, path string) (float64, bool) {
+	parts := strings.Split(path, ".")
+	var cur interface{} = m
+	for _, p := range parts {
+		mm, ok := cur.(map[string]interface{})
+		if !ok {
+			return 0, false
+		}
+		cur, ok = mm[p]
+		if !ok {
+			return 0, false
+		}
+	}
+	f, ok := cur.(float64)
+	return f, ok
+}
+
+func (r *alertRule) validate() error {
+	if r.Stat == "" {
+		return fmt.Errorf("rule %q has no stat", r.Name)
+	}
+	if r.Name == "" {
+		r.Name = r.Stat
+	}
+	if r.Op == "" {
+		r.Op = ">"
+	}
+	if _, err := compare(r.Op, 0, 0); err != nil {
+		return fmt.Errorf("rule %q: %v", r.Name, err)
+	}
+	switch r.Mode {
+	case "", "value", "rate", "delta":
+	default:
+		return fmt.Errorf("rule %q: invalid mode: %q", r.Name, r.Mode)
+	}
+	if len(r.Actions) == 0 {
+		r.Actions = []string{"log"}
+	}
+	for _, a := range r.Actions {
+		switch a {
+		case "log", "store":
+		case "webhook":
+			if r.Webhook == "" {
+				return fmt.Errorf("rule %q: webhook action with no webhook",
+					r.Name)
+			}
+		default:
+			return fmt.Errorf("rule %q: invalid action: %q", r.Name, a)
+		}
+	}
+	return nil
+}
+
+// Compute the observed value for this rule.  Returns false if there's
+// nothing to compare yet (missing stat, or first sample of a rate).
+func (r *alertRule) observe(ts time.Time, m map[string]interface{}) (float64, bool) {
+	v, ok := lookupStat(m, r.Stat)
+	if !ok {
+		return 0, false
+	}
+	prev, prevTS, havePrev := r.prev, r.prevTS, r.havePrev
+	r.prev, r.prevTS, r.havePrev = v, ts, true
+
+	switch r.Mode {
+	case "rate":
+		if !havePrev || !ts.After(prevTS) {
+			return 0, false
+		}
+		return (v - prev) / ts.Sub(prevTS).Seconds(), true
+	case "delta":
+		if !havePrev {
+			return 0, false
+		}
+		return v - prev, true
+	}
+	return v, true
+}
+
+func (r *alertRule) evaluate(ts time.Time, m map[string]interface{}) (alert, bool) {
+	v, ok := r.observe(ts, m)
+	if !ok {
+		return alert{}, false
+	}
+	threshold := r.Value
+	if r.Relative != "" {
+		rel, ok := lookupStat(m, r.Relative)
+		if !ok {
+			return alert{}, false
+		}
+		threshold *= rel
+	}
+	hit, _ := compare(r.Op, v, threshold)
+
+	a := alert{
+		Type:      "alert",
+		TS:        ts,
+		Rule:      r.Name,
+		Stat:      r.Stat,
+		Mode:      r.Mode,
+		Observed:  v,
+		Op:        r.Op,
+		Threshold: threshold,
+	}
+
+	switch {
+	case hit && !r.firing:
+		if r.since.IsZero() {
+			r.since = ts
+		}
+		if ts.Sub(r.since) >= time.Duration(r.For) {
+			r.firing = true
+			a.State = "firing"
+			return a, true
+		}
+	case !hit:
+		r.since = time.Time{}
+		if r.firing {
+			r.firing = false
+			a.State = "resolved"
+			return a, true
+		}
+	}
+	return a, false
+}
+
+func postAlert(url string, a alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	res, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("HTTP error posting alert: %v", res.Status)
+	}
+	return nil
+}
+
+func (al *alerter) fire(r *alertRule, a alert) {
+	for _, action := range r.Actions {
+		switch action {
+		case "log":
+			log.Print(a)
+		case "store":
+			doc := map[string]interface{}{}
+			for k, v := range al.proto {
+				doc[k] = v
+			}
+			doc["ts"] = a.TS
+			doc["type"] = a.Type
+			doc["alert"] = a
+			go store(al.db, a.TS, doc)
+		case "webhook":
+			go func(url string) {
+				if err := al.post(url, a); err != nil {
+					log.Printf("Error posting alert to %v: %v", url, err)
+				}
+			}(r.Webhook)
+		}
+	}
+}
+
+// Evaluate all rules against a sample as returned by fetchOnce.
+func (al *alerter) evaluate(m map[string]interface{}) {
+	if al == nil {
+		return
+	}
+	ts, ok := m["ts"].(time.Time)
+	if !ok {
+		ts = time.Now()
+	}
+	for _, r := range al.rules {
+		if a, fired := r.evaluate(ts, m); fired {
+			al.fire(r, a)
+		}
+	}
+}
+
+func newAlerter(rules []*alertRule, db statstore.Storer,
+	proto map[string]interface{}) (*alerter, error) {
+
+	for _, r := range rules {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &alerter{rules: rules, db: db, proto: proto, post: postAlert}, nil
+}
+
+func loadAlerter(path string, db statstore.Storer,
+	proto map[string]interface{}) (*alerter, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules := []*alertRule{}
+	if err := json.NewDecoder(f).Decode(&rules); err != nil {
+		return nil, err
+	}
+	return newAlerter(rules, db, proto)
+}
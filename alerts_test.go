@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/statcap/statstore"
+)
+
+var basetime = time.Unix(1339646554, 0)
+
+func sample(ts time.Time, all map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"ts": ts, "all": all}
+}
+
+func TestLookupStat(t *testing.T) {
+	m := sample(time.Now(), map[string]interface{}{
+		"evictions": float64(3),
+		"version":   "1.4",
+	})
+
+	if v, ok := lookupStat(m, "all.evictions"); !ok || v != 3 {
+		t.Fatalf("Expected 3, got %v/%v", v, ok)
+	}
+	for _, p := range []string{"all.version", "all.missing", "ts.x", "nope"} {
+		if v, ok := lookupStat(m, p); ok {
+			t.Fatalf("Expected no value at %v, got %v", p, v)
+		}
+	}
+}
+
+func TestAlertRuleValidation(t *testing.T) {
+	tests := []alertRule{
+		{},
+		{Stat: "all.x", Op: "~"},
+		{Stat: "all.x", Mode: "derivative"},
+		{Stat: "all.x", Actions: []string{"page"}},
+		{Stat: "all.x", Actions: []string{"webhook"}},
+	}
+	for _, r := range tests {
+		if err := r.validate(); err == nil {
+			t.Errorf("Expected error validating %+v", r)
+		}
+	}
+
+	r := alertRule{Stat: "all.x"}
+	if err := r.validate(); err != nil {
+		t.Fatalf("Error validating minimal rule: %v", err)
+	}
+	if r.Name != "all.x" || r.Op != ">" || r.Actions[0] != "log" {
+		t.Fatalf("Defaults weren't applied: %+v", r)
+	}
+}
+
+func TestAlertRateWithHold(t *testing.T) {
+	r := &alertRule{Stat: "all.evictions", Mode: "rate", Value: 10,
+		For: jsonDuration(10 * time.Second)}
+	if err := r.validate(); err != nil {
+		t.Fatalf("Error validating: %v", err)
+	}
+
+	tests := []struct {
+		evictions float64
+		state     string
+	}{
+		{0, ""},   // no rate yet
+		{100, ""}, // 20/s, hold starts
+		{200, ""}, // 20/s, held 5s
+		{300, "firing"},
+		{400, ""}, // still firing, nothing new
+		{410, "resolved"},
+		{510, ""}, // hold restarts
+	}
+
+	ts := basetime
+	for i, test := range tests {
+		a, fired := r.evaluate(ts, sample(ts, map[string]interface{}{
+			"evictions": test.evictions,
+		}))
+		if fired != (test.state != "") || a.State != test.state {
+			t.Fatalf("Step %v: expected %q, got %q/%v", i, test.state,
+				a.State, fired)
+		}
+		ts = ts.Add(5 * time.Second)
+	}
+}
+
+func TestAlertDeltaAndRelative(t *testing.T) {
+	oom := &alertRule{Stat: "all.ep_oom_errors", Mode: "delta"}
+	conns := &alertRule{Stat: "all.curr_connections", Value: 0.9,
+		Relative: "all.max_conns"}
+	for _, r := range []*alertRule{oom, conns} {
+		if err := r.validate(); err != nil {
+			t.Fatalf("Error validating %v: %v", r.Stat, err)
+		}
+	}
+
+	ts := basetime
+	m := sample(ts, map[string]interface{}{
+		"ep_oom_errors":    float64(5),
+		"curr_connections": float64(100),
+		"max_conns":        float64(1000),
+	})
+	for _, r := range []*alertRule{oom, conns} {
+		if _, fired := r.evaluate(ts, m); fired {
+			t.Fatalf("Unexpected alert from %v", r.Stat)
+		}
+	}
+
+	ts = ts.Add(time.Second)
+	m = sample(ts, map[string]interface{}{
+		"ep_oom_errors":    float64(6),
+		"curr_connections": float64(901),
+		"max_conns":        float64(1000),
+	})
+	a, fired := oom.evaluate(ts, m)
+	if !fired || a.Observed != 1 {
+		t.Fatalf("Expected oom alert, got %+v/%v", a, fired)
+	}
+	a, fired = conns.evaluate(ts, m)
+	if !fired || a.Threshold != 900 {
+		t.Fatalf("Expected connection alert, got %+v/%v", a, fired)
+	}
+}
+
+type capturingStorer struct {
+	items chan map[string]interface{}
+}
+
+func (c *capturingStorer) Insert(it statstore.StoredItem) (string, string, error) {
+	m := map[string]interface{}{}
+	b, err := json.Marshal(it)
+	if err == nil {
+		err = json.Unmarshal(b, &m)
+	}
+	c.items <- m
+	return "", "", err
+}
+
+func (c *capturingStorer) Close() error {
+	return nil
+}
+
+func TestAlertActions(t *testing.T) {
+	posted := make(chan alert, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		a := alert{}
+		if err := json.NewDecoder(req.Body).Decode(&a); err != nil {
+			t.Errorf("Error decoding posted alert: %v", err)
+		}
+		posted <- a
+	}))
+	defer srv.Close()
+
+	db := &capturingStorer{make(chan map[string]interface{}, 1)}
+	al, err := newAlerter([]*alertRule{{
+		Name:    "evictions",
+		Stat:    "all.evictions",
+		Actions: []string{"log", "store", "webhook"},
+		Webhook: srv.URL,
+	}}, db, map[string]interface{}{"customer": "bob"})
+	if err != nil {
+		t.Fatalf("Error creating alerter: %v", err)
+	}
+
+	al.evaluate(sample(basetime, map[string]interface{}{"evictions": 1.0}))
+
+	select {
+	case a := <-posted:
+		if a.Rule != "evictions" || a.State != "firing" {
+			t.Fatalf("Unexpected posted alert: %+v", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for webhook")
+	}
+
+	select {
+	case m := <-db.items:
+		if m["type"] != "alert" || m["customer"] != "bob" ||
+			!strings.HasPrefix(m["ts"].(string), "2012") {
+			t.Fatalf("Unexpected stored alert: %v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for stored alert")
+	}
+}
@@ -0,0 +1,738 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/statcap/statstore"
+)
+
+// How a stat is combined when samples are merged.
+type statKind int
+
+const (
+	// Numbers that go up and down: mean, min and max.
+	gaugeStat = statKind(iota)
+	// Running totals: the last value (rates still come out right).
+	counterStat
+	// A bucket of a timings histogram such as "cmd_get_8,16".
+	histogramStat
+)
+
+// Memcached and ep-engine stats that only ever count up (until a
+// restart).  Anything else numeric is taken to be a gauge.
+var defaultCounters = []string{
+	"uptime", "time", "rusage_*", "total_connections", "total_items",
+	"cmd_*", "*_hits", "*_misses", "*_cmds", "auth_errors",
+	"bytes_read", "bytes_written", "evictions", "reclaimed",
+	"*_unfetched", "conn_yields", "listen_disabled_num", "rejected_conns",
+	"get_expired", "get_flushed",
+	"ep_bg_fetched", "ep_io_num_*", "ep_io_*_bytes", "ep_total_enqueued",
+	"ep_total_persisted", "ep_total_new_items", "ep_total_del_items",
+}
+
+var histogramBucket = regexp.MustCompile(`^(.+)_\d+,\d+$`)
+
+type statClassifier struct {
+	counters, gauges []string
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c statClassifier) kind(name string) statKind {
+	switch {
+	case matchesAny(c.gauges, name):
+		return gaugeStat
+	case histogramBucket.MatchString(name):
+		return histogramStat
+	case matchesAny(c.counters, name):
+		return counterStat
+	}
+	return gaugeStat
+}
+
+// Keep records up to maxAge old (0 for no limit) at one per interval
+// (0 to keep them as they are).
+type compactTier struct {
+	maxAge   time.Duration
+	interval time.Duration
+}
+
+func (t compactTier) String() string {
+	res := "raw"
+	if t.interval > 0 {
+		res = t.interval.String()
+	}
+	if t.maxAge == 0 {
+		return res
+	}
+	return t.maxAge.String() + ":" + res
+}
+
+// A duration that may also be given in days ("14d").
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %q", s)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// Parse retention tiers such as "2d:raw,14d:1m,90d:1h": records up
+// to two days old are kept as they are, up to 14 days at one a
+// minute, up to 90 days at one an hour, and anything older is
+// dropped.  The last tier may leave out its age ("2d:raw,1h") to
+// keep everything older.
+func parseTiers(s string) ([]compactTier, error) {
+	rv := []compactTier{}
+	parts := strings.Split(s, ",")
+	for i, part := range parts {
+		age, res := "", part
+		if j := strings.Index(part, ":"); j >= 0 {
+			age, res = part[:j], part[j+1:]
+		} else if i != len(parts)-1 {
+			return nil, fmt.Errorf("tier %q has no age", part)
+		}
+
+		t := compactTier{}
+		var err error
+		if age != "" {
+			if t.maxAge, err = parseAge(age); err != nil || t.maxAge <= 0 {
+				return nil, fmt.Errorf("invalid tier age: %q", age)
+			}
+		}
+		if res != "raw" {
+			if t.interval, err = parseAge(res); err != nil || t.interval <= 0 {
+				return nil, fmt.Errorf("invalid tier interval: %q", res)
+			}
+		}
+		if i > 0 {
+			prev := rv[i-1]
+			if t.maxAge != 0 && t.maxAge <= prev.maxAge {
+				return nil, fmt.Errorf("tier ages must increase: %q", s)
+			}
+			if t.interval < prev.interval {
+				return nil, fmt.Errorf("tier intervals must not shrink: %q", s)
+			}
+		}
+		rv = append(rv, t)
+	}
+	return rv, nil
+}
+
+// The tier a record of the given age falls in, or nil if it's past
+// retention.
+func tierFor(tiers []compactTier, age time.Duration) *compactTier {
+	for i := range tiers {
+		if tiers[i].maxAge == 0 || age <= tiers[i].maxAge {
+			return &tiers[i]
+		}
+	}
+	return nil
+}
+
+// Nested maps flattened to paths (keys joined with a NUL, since stat
+// names and server names have dots in them).
+const pathSep = "\x00"
+
+func flatten(prefix string, m map[string]interface{}, into map[string]interface{}) {
+	for k, v := range m {
+		p := prefix + k
+		if sub, ok := v.(map[string]interface{}); ok {
+			flatten(p+pathSep, sub, into)
+			continue
+		}
+		into[p] = v
+	}
+}
+
+func unflatten(flat map[string]interface{}) map[string]interface{} {
+	rv := map[string]interface{}{}
+	for p, v := range flat {
+		keys := strings.Split(p, pathSep)
+		m := rv
+		for _, k := range keys[:len(keys)-1] {
+			sub, ok := m[k].(map[string]interface{})
+			if !ok {
+				sub = map[string]interface{}{}
+				m[k] = sub
+			}
+			m = sub
+		}
+		m[keys[len(keys)-1]] = v
+	}
+	return rv
+}
+
+// One stat over a window.
+type compactStat struct {
+	kind statKind
+	last interface{}
+	// Gauges, weighted by how many samples each value stands for.
+	n             int
+	sum, min, max float64
+}
+
+// The buckets of one histogram over a window.  Buckets are running
+// counts, and a server only reports the ones it has seen, so a bucket
+// seen anywhere in the window is kept at its latest count.  If a
+// count goes down the server restarted, and everything before is
+// forgotten.
+type compactHistogram struct {
+	buckets map[string]float64
+}
+
+func (h *compactHistogram) restarted(bs map[string]float64) bool {
+	for p, f := range bs {
+		if prev, ok := h.buckets[p]; ok && f < prev {
+			return true
+		}
+	}
+	return false
+}
+
+// Samples being merged into one record.
+type compactWindow struct {
+	start    time.Time
+	interval time.Duration
+	samples  int
+	stats    map[string]*compactStat
+	hists    map[string]*compactHistogram
+	// Cluster summaries (group and stat) and how each was summarized.
+	cluster map[string]string
+}
+
+func newCompactWindow(start time.Time, interval time.Duration) *compactWindow {
+	return &compactWindow{
+		start:    start,
+		interval: interval,
+		stats:    map[string]*compactStat{},
+		hists:    map[string]*compactHistogram{},
+		cluster:  map[string]string{},
+	}
+}
+
+// The summaries in a couchbase capture's "cluster" section, by group
+// and stat, with how each was summarized ("sum" or "avg").  Their
+// fields (value, sum, min, max...) can't be merged like stats, so
+// they're made again from the merged per-node stats.
+func clusterSummaries(m map[string]interface{}) map[string]string {
+	cluster, ok := m["cluster"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	rv := map[string]string{}
+	for group, v := range cluster {
+		stats, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for stat, v := range stats {
+			sum, ok := v.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			agg, ok := sum["agg"].(string)
+			if !ok {
+				return nil
+			}
+			rv[group+pathSep+stat] = agg
+		}
+	}
+	return rv
+}
+
+// Summarize a stat across the nodes of a merged group, the way the
+// couchbase capture does.
+func summarize(nodes map[string]interface{}, stat, agg string) map[string]interface{} {
+	names := make([]string, 0, len(nodes))
+	for node := range nodes {
+		names = append(names, node)
+	}
+	sort.Strings(names)
+
+	var rv map[string]interface{}
+	var sum float64
+	n := 0
+	for _, node := range names {
+		st, _ := nodes[node].(map[string]interface{})
+		f, ok := st[stat].(float64)
+		if !ok {
+			continue
+		}
+		if rv == nil {
+			rv = map[string]interface{}{"min": f, "max": f,
+				"min_node": node, "max_node": node}
+		}
+		sum += f
+		n++
+		if f < rv["min"].(float64) {
+			rv["min"], rv["min_node"] = f, node
+		}
+		if f > rv["max"].(float64) {
+			rv["max"], rv["max_node"] = f, node
+		}
+	}
+	if rv == nil {
+		return nil
+	}
+	mean := sum / float64(n)
+	rv["agg"], rv["sum"], rv["mean"], rv["nodes"] = agg, sum, mean, n
+	if agg == "avg" {
+		rv["value"] = mean
+	} else {
+		rv["value"] = sum
+	}
+	return rv
+}
+
+func (w *compactWindow) contains(ts time.Time) bool {
+	return !ts.Before(w.start) && ts.Before(w.start.Add(w.interval))
+}
+
+// The "compact" section of an already compacted record, so merging it
+// again keeps its min, max and weight.
+func previousCompaction(m map[string]interface{}) (int, map[string]interface{}, map[string]interface{}) {
+	c, ok := m["compact"].(map[string]interface{})
+	if !ok {
+		return 1, nil, nil
+	}
+	n := 1
+	if f, ok := c["samples"].(float64); ok && f >= 1 {
+		n = int(f)
+	}
+	mins, maxes := map[string]interface{}{}, map[string]interface{}{}
+	if sub, ok := c["min"].(map[string]interface{}); ok {
+		flatten("", sub, mins)
+	}
+	if sub, ok := c["max"].(map[string]interface{}); ok {
+		flatten("", sub, maxes)
+	}
+	return n, mins, maxes
+}
+
+func (w *compactWindow) add(m map[string]interface{}, c statClassifier) {
+	weight, mins, maxes := previousCompaction(m)
+	w.samples += weight
+
+	cluster := clusterSummaries(m)
+	for k, agg := range cluster {
+		w.cluster[k] = agg
+	}
+
+	flat := map[string]interface{}{}
+	for k, v := range m {
+		if k == "ts" || k == "compact" || (k == "cluster" && cluster != nil) {
+			continue
+		}
+		if sub, ok := v.(map[string]interface{}); ok {
+			flatten(k+pathSep, sub, flat)
+		} else {
+			flat[k] = v
+		}
+	}
+
+	// Buckets by histogram (the path with the range taken off).
+	buckets := map[string]map[string]float64{}
+	for p, v := range flat {
+		name := p[strings.LastIndex(p, pathSep)+1:]
+		f, numeric := v.(float64)
+		kind := c.kind(name)
+		if !numeric {
+			kind = counterStat
+		}
+
+		if kind == histogramStat {
+			h := p[:len(p)-len(name)] + histogramBucket.FindStringSubmatch(name)[1]
+			if buckets[h] == nil {
+				buckets[h] = map[string]float64{}
+			}
+			buckets[h][p] = f
+			continue
+		}
+
+		st := w.stats[p]
+		if st == nil {
+			st = &compactStat{kind: kind}
+			w.stats[p] = st
+		}
+		st.last = v
+		if kind != gaugeStat || st.kind != gaugeStat {
+			// Something that was a number and now isn't is kept as
+			// whatever it was last.
+			st.kind = counterStat
+			continue
+		}
+		lo, hi := f, f
+		if x, ok := mins[p].(float64); ok {
+			lo = x
+		}
+		if x, ok := maxes[p].(float64); ok {
+			hi = x
+		}
+		if st.n == 0 || lo < st.min {
+			st.min = lo
+		}
+		if st.n == 0 || hi > st.max {
+			st.max = hi
+		}
+		st.n += weight
+		st.sum += f * float64(weight)
+	}
+
+	for h, bs := range buckets {
+		hist := w.hists[h]
+		if hist == nil || hist.restarted(bs) {
+			hist = &compactHistogram{buckets: map[string]float64{}}
+			w.hists[h] = hist
+		}
+		for p, f := range bs {
+			hist.buckets[p] = f
+		}
+	}
+}
+
+// The merged record.
+func (w *compactWindow) record() map[string]interface{} {
+	flat := map[string]interface{}{}
+	mins, maxes := map[string]interface{}{}, map[string]interface{}{}
+	for p, st := range w.stats {
+		if st.kind != gaugeStat {
+			flat[p] = st.last
+			continue
+		}
+		flat[p] = st.sum / float64(st.n)
+		mins[p], maxes[p] = st.min, st.max
+	}
+	for _, h := range w.hists {
+		for p, v := range h.buckets {
+			flat[p] = v
+		}
+	}
+
+	rv := unflatten(flat)
+	cluster := map[string]interface{}{}
+	for k, agg := range w.cluster {
+		group, stat, _ := strings.Cut(k, pathSep)
+		nodes, _ := rv[group].(map[string]interface{})
+		if sum := summarize(nodes, stat, agg); sum != nil {
+			if cluster[group] == nil {
+				cluster[group] = map[string]interface{}{}
+			}
+			cluster[group].(map[string]interface{})[stat] = sum
+		}
+	}
+	if len(cluster) > 0 {
+		rv["cluster"] = cluster
+	}
+	rv["ts"] = w.start
+	rv["compact"] = map[string]interface{}{
+		"interval": w.interval.String(),
+		"samples":  w.samples,
+		"min":      unflatten(mins),
+		"max":      unflatten(maxes),
+	}
+	return rv
+}
+
+type compactOptions struct {
+	tiers      []compactTier
+	now        time.Time
+	classifier statClassifier
+}
+
+type compactResult struct {
+	read, written, windows, dropped, skipped int
+}
+
+// What a sample is a sample of: its top level strings, which are
+// the bucket and whatever the proto says about the run.  Samples are
+// only ever merged with others of the same source.
+func sampleSource(m map[string]interface{}) string {
+	keys := []string{}
+	for k, v := range m {
+		if _, ok := v.(string); ok && k != "ts" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k + "=" + m[k].(string) + pathSep)
+	}
+	return b.String()
+}
+
+// The types of event document statcap and the couchbase capture
+// write alongside samples.  A proto can have a "type" of its own, so
+// it's only an event if it's one of these.
+var eventTypes = map[string]bool{
+	"alert":      true,
+	"connection": true,
+	"topology":   true,
+}
+
+func isEvent(m map[string]interface{}) bool {
+	t, _ := m["type"].(string)
+	return eventTypes[t]
+}
+
+// Copy r to w, downsampling and dropping records as the tiers say.
+// Each source (bucket, run) has its own window open at a time.
+// Records are expected in time order (a merge reader will put several
+// captures in order); one that goes back in time just starts a new
+// window.
+func compact(r statstore.Reader, w statstore.Storer,
+	opts compactOptions) (res compactResult, err error) {
+
+	windows := map[string]*compactWindow{}
+	// Event documents (alerts, connection changes) that turned up
+	// while windows were open, written unchanged after them.
+	var events []statstore.StoredItem
+
+	write := func(it statstore.StoredItem) error {
+		_, _, err := w.Insert(it)
+		if err == nil {
+			res.written++
+		}
+		return err
+	}
+	// Write out (in time order) and close the windows done says are
+	// done, then any events if that was the last of them.
+	flush := func(done func(*compactWindow) bool) error {
+		keys := []string{}
+		for k, win := range windows {
+			if done(win) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			a, b := windows[keys[i]], windows[keys[j]]
+			if !a.start.Equal(b.start) {
+				return a.start.Before(b.start)
+			}
+			return keys[i] < keys[j]
+		})
+		for _, k := range keys {
+			win := windows[k]
+			delete(windows, k)
+			if err := write(statstore.NewItem(win.record(), win.start)); err != nil {
+				return err
+			}
+			res.windows++
+		}
+		if len(windows) > 0 {
+			return nil
+		}
+		for len(events) > 0 {
+			if err := write(events[0]); err != nil {
+				return err
+			}
+			events = events[1:]
+		}
+		return nil
+	}
+	all := func(*compactWindow) bool { return true }
+
+	for {
+		it, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Don't lose what's been merged so far.
+			return res, errors.Join(err, flush(all))
+		}
+		res.read++
+
+		ts, err := it.TimestampE()
+		if err != nil {
+			log.Printf("Skipping record %v: %v", res.read, err)
+			res.skipped++
+			continue
+		}
+		m, err := it.Map()
+		if err != nil {
+			log.Printf("Skipping record %v: %v", res.read, err)
+			res.skipped++
+			continue
+		}
+
+		tier := tierFor(opts.tiers, opts.now.Sub(ts))
+		if tier == nil {
+			res.dropped++
+			continue
+		}
+		err = flush(func(win *compactWindow) bool {
+			return !ts.Before(win.start.Add(win.interval))
+		})
+		if err != nil {
+			return res, err
+		}
+
+		if isEvent(m) {
+			if len(windows) > 0 {
+				events = append(events, it)
+			} else if err := write(it); err != nil {
+				return res, err
+			}
+			continue
+		}
+		if tier.interval == 0 {
+			if err := flush(all); err != nil {
+				return res, err
+			}
+			if err := write(it); err != nil {
+				return res, err
+			}
+			continue
+		}
+
+		src := sampleSource(m)
+		win := windows[src]
+		if win != nil && (win.interval != tier.interval || !win.contains(ts)) {
+			err := flush(func(w *compactWindow) bool { return w == win })
+			if err != nil {
+				return res, err
+			}
+			win = nil
+		}
+		if win == nil {
+			win = newCompactWindow(ts.Truncate(tier.interval), tier.interval)
+			windows[src] = win
+		}
+		win.add(m, opts.classifier)
+	}
+	return res, flush(all)
+}
+
+func splitPatterns(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// statcap compact [flags] capture out
+//
+// Returns the exit status: 0 if the compacted capture was written, 1
+// if something went wrong, 2 for bad usage.
+func compactMain(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("compact", flag.ContinueOnError)
+	interval := fs.Duration("interval", time.Minute,
+		"Time between records in the compacted capture")
+	tiersSpec := fs.String("tiers", "",
+		"Retention tiers by age, e.g. 2d:raw,14d:1m,90d:1h (overrides -interval)")
+	nowFlag := fs.String("now", "",
+		"RFC 3339 time tier ages are measured from (default now)")
+	counters := fs.String("counters", "",
+		"More stats (comma separated patterns) to treat as counters")
+	gauges := fs.String("gauges", "",
+		"Stats (comma separated patterns) to treat as gauges even if they look like counters")
+	force := fs.Bool("force", false, "Overwrite an existing output file")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: statcap compact [flags] capture out\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	in, outPath := fs.Arg(0), fs.Arg(1)
+
+	opts := compactOptions{
+		tiers: []compactTier{{interval: *interval}},
+		now:   time.Now(),
+		classifier: statClassifier{
+			counters: append(splitPatterns(*counters), defaultCounters...),
+			gauges:   splitPatterns(*gauges),
+		},
+	}
+	if *interval <= 0 {
+		fmt.Fprintf(fs.Output(), "-interval must be positive\n")
+		return 2
+	}
+	if *tiersSpec != "" {
+		var err error
+		if opts.tiers, err = parseTiers(*tiersSpec); err != nil {
+			fmt.Fprintf(fs.Output(), "%v\n", err)
+			return 2
+		}
+	}
+	if *nowFlag != "" {
+		var err error
+		if opts.now, err = time.Parse(time.RFC3339, *nowFlag); err != nil {
+			fmt.Fprintf(fs.Output(), "Invalid -now: %v\n", err)
+			return 2
+		}
+	}
+
+	r, err := statstore.GetStoreReader(in)
+	if err != nil {
+		log.Printf("Error opening %v: %v", in, err)
+		return 1
+	}
+	defer r.Close()
+
+	h := statstore.NewHeader()
+	if orig, err := r.Header(); err != nil {
+		log.Printf("Error reading the header of %v: %v", in, err)
+	} else if orig != nil {
+		h.Server, h.Interval, h.Proto = orig.Server, orig.Interval, orig.Proto
+	}
+	if len(opts.tiers) == 1 && opts.tiers[0].interval > 0 {
+		h.Interval = opts.tiers[0].interval.String()
+	}
+	tiers := make([]string, 0, len(opts.tiers))
+	for _, t := range opts.tiers {
+		tiers = append(tiers, t.String())
+	}
+	h.Extra = map[string]interface{}{
+		"compacted_from": in,
+		"tiers":          strings.Join(tiers, ","),
+	}
+
+	mode := statstore.CreateNew
+	if *force {
+		mode = statstore.Overwrite
+	}
+	w, err := statstore.GetStorerHeader(outPath, mode, h)
+	if err != nil {
+		log.Printf("Error creating %v: %v", outPath, err)
+		return 1
+	}
+
+	res, err := compact(r, w, opts)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	fmt.Fprintf(out, "Read %d records, wrote %d (%d merged), dropped %d past retention, skipped %d\n",
+		res.read, res.written, res.windows, res.dropped, res.skipped)
+	if err != nil {
+		log.Printf("Error compacting %v: %v", in, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dustin/statcap/statstore"
+)
+
+func TestParseTiers(t *testing.T) {
+	tests := []struct {
+		in  string
+		exp []compactTier
+	}{
+		{"1m", []compactTier{{0, time.Minute}}},
+		{"2d:raw,14d:1m,90d:1h", []compactTier{
+			{48 * time.Hour, 0},
+			{14 * 24 * time.Hour, time.Minute},
+			{90 * 24 * time.Hour, time.Hour}}},
+		{"6h:raw,1h", []compactTier{{6 * time.Hour, 0}, {0, time.Hour}}},
+	}
+	for _, test := range tests {
+		got, err := parseTiers(test.in)
+		if err != nil || !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%v: expected %v, got %v/%v", test.in, test.exp, got, err)
+		}
+	}
+
+	for _, in := range []string{"", "1h,1d:1m", "2d:1h,1d:1h", "1d:1h,2d:1m",
+		"1d:soon", "x:1m", "0s:1m"} {
+		if got, err := parseTiers(in); err == nil {
+			t.Errorf("Expected an error parsing %q, got %v", in, got)
+		}
+	}
+}
+
+// Samples every five seconds for n minutes from a minute boundary.
+func writeSamples(t *testing.T, filename string, start time.Time, n int) {
+	fs, err := statstore.GetStorer(filename)
+	if err != nil {
+		t.Fatalf("Error opening %v: %v", filename, err)
+	}
+	defer fs.Close()
+	for i := 0; i < n*12; i++ {
+		timings := map[string]interface{}{"cmd_get_0,8": float64(i)}
+		if i%12 == 3 {
+			// Only reported some of the time.
+			timings["cmd_get_8,16"] = float64(i)
+		}
+		ts := start.Add(time.Duration(i) * 5 * time.Second)
+		_, _, err := fs.Insert(statstore.NewItem(map[string]interface{}{
+			"name": "run",
+			// From the proto, not an event.
+			"type": "soak",
+			"all": map[string]interface{}{
+				"curr_items": float64(i % 12),
+				"cmd_get":    float64(10 * i),
+				"version":    "1.4",
+			},
+			"timings": timings,
+		}, ts))
+		if err != nil {
+			t.Fatalf("Error storing item: %v", err)
+		}
+		if i == 7 {
+			fs.Insert(statstore.NewItem(map[string]interface{}{
+				"type": "alert", "rule": "test"}, ts))
+		}
+	}
+}
+
+func readAll(t *testing.T, filename string) []statstore.StoredItem {
+	r, err := statstore.GetStoreReader(filename)
+	if err != nil {
+		t.Fatalf("Error opening %v: %v", filename, err)
+	}
+	defer r.Close()
+	rv := []statstore.StoredItem{}
+	for {
+		it, err := r.Next()
+		if err == io.EOF {
+			return rv
+		}
+		if err != nil {
+			t.Fatalf("Error reading %v: %v", filename, err)
+		}
+		rv = append(rv, it)
+	}
+}
+
+func runCompact(t *testing.T, args ...string) {
+	out := &bytes.Buffer{}
+	if rv := compactMain(args, out); rv != 0 {
+		t.Fatalf("compact %v failed: %v %s", args, rv, out)
+	}
+}
+
+func expectStat(t *testing.T, it statstore.StoredItem, path string, exp float64) {
+	if got, ok := it.Float(path); !ok || got != exp {
+		t.Errorf("At %v, expected %v = %v, got %v", it.Timestamp(), path, exp, got)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	in, out, again := "testcompact-in.gz", "testcompact-1m.gz", "testcompact-2m.zip"
+	defer os.Remove(in)
+	defer os.Remove(out)
+	defer os.Remove(again)
+
+	start := basetime.Truncate(time.Minute)
+	writeSamples(t, in, start, 2)
+	runCompact(t, "-interval=1m", in, out)
+
+	items := readAll(t, out)
+	if len(items) != 3 {
+		t.Fatalf("Expected two records and an event, got %v", len(items))
+	}
+	first, ev, second := items[0], items[1], items[2]
+	if ty, _ := ev.String("type"); ty != "alert" ||
+		!ev.Timestamp().Equal(start.Add(35*time.Second)) {
+		t.Errorf("Expected the alert after the first minute, got %v", ev.Timestamp())
+	}
+	if !first.Timestamp().Equal(start) ||
+		!second.Timestamp().Equal(start.Add(time.Minute)) {
+		t.Fatalf("Wrong times: %v, %v", first.Timestamp(), second.Timestamp())
+	}
+
+	// Gauges: mean, min and max.
+	expectStat(t, first, "all.curr_items", 5.5)
+	expectStat(t, first, "compact.min.all.curr_items", 0)
+	expectStat(t, first, "compact.max.all.curr_items", 11)
+	expectStat(t, first, "compact.samples", 12)
+	// Counters: the last value.
+	expectStat(t, first, "all.cmd_get", 110)
+	expectStat(t, second, "all.cmd_get", 230)
+	if v, _ := second.String("all.version"); v != "1.4" {
+		t.Errorf("Expected the version to carry through, got %q", v)
+	}
+	if v, _ := second.String("name"); v != "run" {
+		t.Errorf("Expected the name to carry through, got %q", v)
+	}
+	// Histograms: every bucket seen, at its latest count.
+	expectStat(t, first, "timings.cmd_get_0,8", 11)
+	expectStat(t, first, "timings.cmd_get_8,16", 3)
+	expectStat(t, second, "timings.cmd_get_0,8", 23)
+	expectStat(t, second, "timings.cmd_get_8,16", 15)
+
+	r, err := statstore.GetStoreReader(out)
+	if err != nil {
+		t.Fatalf("Error opening %v: %v", out, err)
+	}
+	h, err := r.Header()
+	r.Close()
+	if err != nil || h == nil || h.Interval != "1m0s" ||
+		h.Extra["compacted_from"] != in {
+		t.Errorf("Wrong header: %+v %v", h, err)
+	}
+
+	// Compacting again keeps the extremes and weights the means.
+	runCompact(t, "-interval=2m", out, again)
+	items = readAll(t, again)
+	if len(items) != 2 {
+		t.Fatalf("Expected a record and an event, got %v", len(items))
+	}
+	expectStat(t, items[0], "all.curr_items", 5.5)
+	expectStat(t, items[0], "compact.min.all.curr_items", 0)
+	expectStat(t, items[0], "compact.max.all.curr_items", 11)
+	expectStat(t, items[0], "compact.samples", 24)
+	expectStat(t, items[0], "all.cmd_get", 230)
+}
+
+func TestCompactTiers(t *testing.T) {
+	in, out := "testcompacttiers-in.gz", "testcompacttiers-out.gz"
+	defer os.Remove(in)
+	defer os.Remove(out)
+
+	start := basetime.Truncate(time.Minute)
+	writeSamples(t, in, start, 3)
+
+	// At the end, the last minute is kept as it was, the one before
+	// is merged, and the first is past retention.
+	now := start.Add(3 * time.Minute)
+	runCompact(t, "-now="+now.Format(time.RFC3339), "-tiers=1m:raw,2m:1m",
+		"-gauges=cmd_get", in, out)
+	items := readAll(t, out)
+	if len(items) != 13 {
+		t.Fatalf("Expected 13 records, got %v", len(items))
+	}
+	if !items[0].Timestamp().Equal(start.Add(time.Minute)) {
+		t.Fatalf("Expected the merged minute first, got %v", items[0].Timestamp())
+	}
+	// Made a gauge.
+	expectStat(t, items[0], "all.cmd_get", 175)
+	for i, it := range items[1:] {
+		exp := start.Add(2*time.Minute + time.Duration(i)*5*time.Second)
+		if !it.Timestamp().Equal(exp) {
+			t.Fatalf("Expected a raw record at %v, got %v", exp, it.Timestamp())
+		}
+	}
+}
+
+func TestCompactBuckets(t *testing.T) {
+	in, out := "testcompactbuckets-in.gz", "testcompactbuckets-out.gz"
+	defer os.Remove(in)
+	defer os.Remove(out)
+
+	// One document per bucket per sample, as the couchbase capture
+	// writes them.
+	start := basetime.Truncate(time.Minute)
+	fs, err := statstore.GetStorer(in)
+	if err != nil {
+		t.Fatalf("Error opening %v: %v", in, err)
+	}
+	for i := 0; i < 24; i++ {
+		ts := start.Add(time.Duration(i) * 5 * time.Second)
+		for bucket, items := range map[string]float64{"a": 10, "b": 1000} {
+			fs.Insert(statstore.NewItem(map[string]interface{}{
+				"name":   "run",
+				"bucket": bucket,
+				"all":    map[string]interface{}{"curr_items": items},
+			}, ts))
+		}
+	}
+	fs.Close()
+
+	runCompact(t, "-interval=1m", in, out)
+	items := readAll(t, out)
+	if len(items) != 4 {
+		t.Fatalf("Expected a record per bucket per minute, got %v", len(items))
+	}
+	for i, it := range items {
+		exp := start.Add(time.Duration(i/2) * time.Minute)
+		if !it.Timestamp().Equal(exp) {
+			t.Errorf("Expected record %v at %v, got %v", i, exp, it.Timestamp())
+		}
+		bucket, _ := it.String("bucket")
+		switch bucket {
+		case "a":
+			expectStat(t, it, "all.curr_items", 10)
+		case "b":
+			expectStat(t, it, "all.curr_items", 1000)
+		default:
+			t.Errorf("Unexpected bucket %q", bucket)
+		}
+		expectStat(t, it, "compact.samples", 12)
+	}
+}
+
+func TestCompactCluster(t *testing.T) {
+	in, out := "testcompactcluster-in.gz", "testcompactcluster-out.gz"
+	defer os.Remove(in)
+	defer os.Remove(out)
+
+	// Per node stats and their summary, as the couchbase capture
+	// writes them.
+	summary := func(agg string, a, b float64) map[string]interface{} {
+		sum := a + b
+		value := sum
+		if agg == "avg" {
+			value = sum / 2
+		}
+		return map[string]interface{}{"agg": agg, "value": value,
+			"sum": sum, "min": a, "max": b, "mean": sum / 2,
+			"min_node": "n1:8091", "max_node": "n2:8091", "nodes": 2.0}
+	}
+	start := basetime.Truncate(time.Minute)
+	fs, err := statstore.GetStorer(in)
+	if err != nil {
+		t.Fatalf("Error opening %v: %v", in, err)
+	}
+	for i := 0; i < 12; i++ {
+		f := float64(i)
+		fs.Insert(statstore.NewItem(map[string]interface{}{
+			"bucket": "default",
+			"all": map[string]interface{}{
+				"n1:8091": map[string]interface{}{
+					"cmd_get": 10 * f, "curr_items": float64(i % 12), "uptime": f},
+				"n2:8091": map[string]interface{}{
+					"cmd_get": 20 * f, "curr_items": 100.0, "uptime": f + 100},
+			},
+			"cluster": map[string]interface{}{
+				"all": map[string]interface{}{
+					"cmd_get":    summary("sum", 10*f, 20*f),
+					"curr_items": summary("sum", float64(i%12), 100),
+					"uptime":     summary("avg", f, f+100),
+				},
+			},
+		}, start.Add(time.Duration(i)*5*time.Second)))
+	}
+	fs.Close()
+
+	runCompact(t, "-interval=1m", in, out)
+	items := readAll(t, out)
+	if len(items) != 1 {
+		t.Fatalf("Expected one record, got %v", len(items))
+	}
+	it := items[0]
+	expectStat(t, it, "all.n1:8091.cmd_get", 110)
+	expectStat(t, it, "all.n2:8091.curr_items", 100)
+	// Made again from the merged per node stats.
+	expectStat(t, it, "cluster.all.cmd_get.value", 330)
+	expectStat(t, it, "cluster.all.cmd_get.sum", 330)
+	expectStat(t, it, "cluster.all.cmd_get.max", 220)
+	expectStat(t, it, "cluster.all.curr_items.value", 105.5)
+	expectStat(t, it, "cluster.all.curr_items.min", 5.5)
+	expectStat(t, it, "cluster.all.uptime.value", 61)
+	expectStat(t, it, "cluster.all.uptime.nodes", 2)
+	if v, _ := it.String("cluster.all.cmd_get.max_node"); v != "n2:8091" {
+		t.Errorf("Expected n2 to have the most gets, got %q", v)
+	}
+	if v, _ := it.String("cluster.all.uptime.agg"); v != "avg" {
+		t.Errorf("Expected uptime to stay averaged, got %q", v)
+	}
+}
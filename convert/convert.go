@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"io"
 	"log"
 	"os"
@@ -21,7 +22,9 @@ func storer(w statstore.Storer, ch <-chan statstore.StoredItem) {
 	defer wg.Done()
 
 	for e := range ch {
-		w.Insert(e)
+		if _, _, err := w.Insert(e); err != nil {
+			log.Printf("Error storing an entry: %v", err)
+		}
 	}
 }
 
@@ -29,7 +32,14 @@ func main() {
 	r, err := statstore.GetStoreReader(os.Args[1])
 	maybefatal(err)
 	defer r.Close()
-	w, err := statstore.GetStorer(os.Args[2])
+	// The copy describes the same capture as the original.
+	h := statstore.NewHeader()
+	if orig, err := r.Header(); err != nil {
+		log.Printf("Error reading the header, writing a new one: %v", err)
+	} else if orig != nil {
+		h = *orig
+	}
+	w, err := statstore.GetStorerHeader(os.Args[2], statstore.CreateNew, h)
 	maybefatal(err)
 	defer w.Close()
 
@@ -38,16 +48,30 @@ func main() {
 	wg.Add(1)
 	go storer(w, ch)
 
+	lastErr := ""
 	for {
 		m, err := r.Next()
 		if err == io.EOF {
-			return
+			break
+		}
+		if err != nil {
+			// Damaged records are reported as they're met, but a
+			// reader that can't get past one repeats it.
+			if err.Error() == lastErr || errors.Is(err, statstore.ErrTruncated) {
+				log.Printf("Error reading an entry, stopping: %v", err)
+				break
+			}
+			lastErr = err.Error()
+			log.Printf("Skipping an entry: %v", err)
+			continue
 		}
+		lastErr = ""
+		ts, err := m.TimestampE()
 		if err != nil {
-			log.Printf("Error reading an entry, stopping: %v", err)
-			return
+			log.Printf("Skipping an entry: %v", err)
+			continue
 		}
-		log.Printf("Recording entry from %v", m.Timestamp())
+		log.Printf("Recording entry from %v", ts)
 		ch <- m
 	}
 	close(ch)
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"sort"
+)
+
+var averageStats = flag.String("average",
+	"uptime,time,*_ratio,*_pct,*_percent,*_resident_*",
+	"Stats summarized across the cluster by mean instead of sum; "+
+		"comma separated patterns")
+
+// A numeric stat summarized across all the nodes that reported it.
+type statSummary struct {
+	// "sum" or "avg", saying which of Sum or Mean is in Value.
+	Agg   string  `json:"agg"`
+	Value float64 `json:"value"`
+
+	Sum     float64 `json:"sum"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+	Mean    float64 `json:"mean"`
+	MinNode string  `json:"min_node"`
+	MaxNode string  `json:"max_node"`
+	Nodes   int     `json:"nodes"`
+}
+
+// Summarize per-node numeric stats across the cluster.  Stats
+// matching any of the average patterns take their value from the
+// mean, everything else from the sum.  Non-numeric stats are
+// skipped.
+func aggregate(pernode map[string]map[string]interface{},
+	average []string) map[string]*statSummary {
+
+	nodes := make([]string, 0, len(pernode))
+	for node := range pernode {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	rv := map[string]*statSummary{}
+	for _, node := range nodes {
+		for stat, v := range pernode[node] {
+			f, ok := v.(float64)
+			if !ok {
+				continue
+			}
+			s, ok := rv[stat]
+			if !ok {
+				s = &statSummary{Min: f, Max: f,
+					MinNode: node, MaxNode: node}
+				rv[stat] = s
+			}
+			s.Sum += f
+			s.Nodes++
+			if f < s.Min {
+				s.Min, s.MinNode = f, node
+			}
+			if f > s.Max {
+				s.Max, s.MaxNode = f, node
+			}
+		}
+	}
+
+	for stat, s := range rv {
+		s.Mean = s.Sum / float64(s.Nodes)
+		if matchesAny(average, stat) {
+			s.Agg, s.Value = "avg", s.Mean
+		} else {
+			s.Agg, s.Value = "sum", s.Sum
+		}
+	}
+	return rv
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	pernode := map[string]map[string]interface{}{
+		"a:8091": {"curr_items": 10.0, "uptime": 100.0, "version": "2.0"},
+		"b:8091": {"curr_items": 30.0, "uptime": 300.0, "version": "2.0"},
+		"c:8091": {"curr_items": 20.0},
+	}
+
+	agg := aggregate(pernode, []string{"uptime"})
+
+	if _, ok := agg["version"]; ok {
+		t.Fatalf("Non-numeric stat was aggregated: %+v", agg["version"])
+	}
+
+	items := agg["curr_items"]
+	exp := statSummary{Agg: "sum", Value: 60, Sum: 60, Min: 10, Max: 30,
+		Mean: 20, MinNode: "a:8091", MaxNode: "b:8091", Nodes: 3}
+	if *items != exp {
+		t.Fatalf("Expected %+v, got %+v", exp, *items)
+	}
+
+	uptime := agg["uptime"]
+	if uptime.Agg != "avg" || uptime.Value != 200 || uptime.Nodes != 2 {
+		t.Fatalf("Expected averaged uptime, got %+v", *uptime)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+
+	"github.com/couchbaselabs/go-couchbase"
+)
+
+var poolName = flag.String("pool", "default", "couchbase pool name")
+var bucketPassword = flag.String("bucketPassword", "",
+	"SASL password for the bucket(s)")
+var restUser = flag.String("user", "", "REST (admin) username")
+var restPassword = flag.String("password", "", "REST (admin) password")
+var credsFile = flag.String("credentials", "",
+	"JSON file of credentials, so they needn't be on the command line")
+
+// Credentials, as read from -credentials and the command line.
+//
+//	{
+//	    "user": "Administrator",
+//	    "password": "secret",
+//	    "bucketPassword": "for any bucket not listed below",
+//	    "buckets": {"sessions": "sessionpw"}
+//	}
+type credentials struct {
+	User           string            `json:"user"`
+	Password       string            `json:"password"`
+	BucketPassword string            `json:"bucketPassword"`
+	Buckets        map[string]string `json:"buckets"`
+}
+
+var creds credentials
+
+// Load the credentials file, letting command line flags win.
+func loadCredentials() error {
+	if *credsFile != "" {
+		f, err := os.Open(*credsFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(&creds); err != nil {
+			return err
+		}
+	}
+	if *restUser != "" {
+		creds.User = *restUser
+	}
+	if *restPassword != "" {
+		creds.Password = *restPassword
+	}
+	if *bucketPassword != "" {
+		creds.BucketPassword = *bucketPassword
+	}
+	return nil
+}
+
+func (c credentials) bucketPassword(name string) string {
+	if pw, ok := c.Buckets[name]; ok {
+		return pw
+	}
+	return c.BucketPassword
+}
+
+// Credentials for talking to a bucket: the admin's for the REST API
+// (if we have them) and the bucket's own for SASL on its memcached
+// connections.  The REST client ignores credentials in the URL, so
+// they have to come from here.
+type bucketAuth struct {
+	user, password         string
+	bucket, bucketPassword string
+}
+
+// Fails to build against a go-couchbase too old to keep REST and SASL
+// credentials apart.
+var _ couchbase.AuthWithSaslHandler = bucketAuth{}
+
+func (c credentials) auth(bucket string) bucketAuth {
+	a := bucketAuth{
+		user:           c.User,
+		password:       c.Password,
+		bucket:         bucket,
+		bucketPassword: c.bucketPassword(bucket),
+	}
+	if a.user == "" {
+		// Without an admin, the bucket's credentials are all there is.
+		a.user, a.password = a.bucket, a.bucketPassword
+	}
+	return a
+}
+
+func (a bucketAuth) GetCredentials() (string, string, string) {
+	return a.user, a.password, a.bucket
+}
+
+func (a bucketAuth) GetSaslCredentials() (string, string) {
+	return a.bucket, a.bucketPassword
+}
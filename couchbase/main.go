@@ -6,6 +6,8 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"path"
+	"sort"
 	"strings"
 	"time"
 
@@ -20,12 +22,24 @@ var sleepTime *uint = flag.Uint("sleep", 5,
 var server *string = flag.String("server", "http://localhost:8091/",
 	"couchbase cluster to connect to")
 var bucket *string = flag.String("bucket", "default", "couchbase bucket name")
+var allBuckets = flag.Bool("allBuckets", false,
+	"Capture every bucket in the pool (see -include and -exclude)")
+var includeBuckets = flag.String("include", "",
+	"Buckets to capture, as comma separated patterns (implies -allBuckets)")
+var excludeBuckets = flag.String("exclude", "",
+	"Buckets not to capture, as comma separated patterns")
 var outPath *string = flag.String("out", "cap.json.gz",
 	"http://couch.db/path or a /file/path")
+var appendOut = flag.Bool("append", false,
+	"Append to an existing -out file instead of refusing to start")
+var forceOut = flag.Bool("force", false,
+	"Overwrite an existing -out file instead of refusing to start")
 var protoFile *string = flag.String("proto", "",
 	"Proto document, into which timings stats will be added")
 var additionalStats *string = flag.String("stats", "timings,kvtimings",
 	"stats to fetch beyond toplevel; comma separated")
+var refreshTime = flag.Duration("refresh", time.Minute,
+	"How often to refresh the cluster map")
 
 // That from which we get stats
 type fetcher interface {
@@ -55,35 +69,315 @@ func getNumericStats(client fetcher, which string) (rv map[string]map[string]int
 	return
 }
 
-func connect() *couchbase.Bucket {
-	bucket, err := couchbase.GetBucket(*server, "default", *bucket)
+func getBucket(name string) (*couchbase.Bucket, error) {
+	client, err := couchbase.ConnectWithAuth(*server, creds.auth(name))
 	if err != nil {
-		log.Printf("Error connecting to %s: %v", *server, err)
+		return nil, err
+	}
+	pool, err := client.GetPool(*poolName)
+	if err != nil {
+		return nil, err
+	}
+	return pool.GetBucket(name)
+}
+
+func connect(name string) *couchbase.Bucket {
+	bucket, err := getBucket(name)
+	if err != nil {
+		log.Printf("Error connecting to %s/%s: %v", *server, name, err)
 		return nil
 	}
 	return bucket
 }
 
-func fetchOnce(proto map[string]interface{}) (int, map[string]interface{}) {
+// Find the names of all the buckets in the pool.
+func discoverBuckets() ([]string, error) {
+	var client couchbase.Client
+	var err error
+	if creds.User != "" {
+		client, err = couchbase.ConnectWithAuth(*server, creds.auth(""))
+	} else {
+		client, err = couchbase.Connect(*server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pool, err := client.GetPool(*poolName)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]string, 0, len(pool.BucketMap))
+	for name := range pool.BucketMap {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return rv, nil
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter bucket names through include and exclude patterns.  An
+// empty include list includes everything.
+func selectBuckets(names, include, exclude []string) []string {
+	rv := []string{}
+	for _, name := range names {
+		if len(include) > 0 && !matchesAny(include, name) {
+			continue
+		}
+		if matchesAny(exclude, name) {
+			continue
+		}
+		rv = append(rv, name)
+	}
+	return rv
+}
+
+// A bucket connection kept across samples.  It's refreshed
+// periodically and whenever it looks like the cluster map is stale,
+// and only reconnected when something fails.  Every connection
+// change is recorded in the output stream.
+type bucketConn struct {
+	name      string
+	bucket    *couchbase.Bucket
+	refreshed time.Time
+	topo      *topology
+
+	db    statstore.Storer
+	proto map[string]interface{}
+}
+
+// Store an event document of the given type for this bucket.
+func (c *bucketConn) record(typ string, fields map[string]interface{}) {
+	ev := map[string]interface{}{}
+	for k, v := range c.proto {
+		ev[k] = v
+	}
+	for k, v := range fields {
+		ev[k] = v
+	}
+	now := time.Now()
+	ev["ts"] = now
+	ev["type"] = typ
+	ev["bucket"] = c.name
+	go store(c.db, now, ev)
+}
+
+func (c *bucketConn) event(name, reason string) {
+	log.Printf("Connection %v: %v", name, reason)
+
+	c.record("connection", map[string]interface{}{
+		"event":  name,
+		"reason": reason,
+	})
+}
+
+// (Re)connect, throwing away any existing connection.
+func (c *bucketConn) connect(reason string) {
+	name := "connect"
+	if c.bucket != nil {
+		c.bucket.Close()
+		c.bucket = nil
+		name = "reconnect"
+	}
+	c.bucket = connect(c.name)
+	if c.bucket == nil {
+		c.event("connect-failed", reason)
+		return
+	}
+	c.refreshed = time.Now()
+	c.event(name, reason)
+}
+
+// Refresh the cluster map, reconnecting if that doesn't work.
+func (c *bucketConn) refresh() {
+	if err := c.bucket.Refresh(); err != nil {
+		c.connect("refresh failed: " + err.Error())
+		return
+	}
+	c.refreshed = time.Now()
+}
+
+// Get a usable connection, or nil if there isn't one.
+func (c *bucketConn) fetcher() fetcher {
+	switch {
+	case c.bucket == nil:
+		c.connect("no connection")
+	case time.Since(c.refreshed) > *refreshTime:
+		c.refresh()
+	}
+	if c.bucket == nil {
+		return nil
+	}
+	return c.bucket
+}
+
+// Look at what a sample got back and decide whether the connection
+// needs attention before the next one.
+func (c *bucketConn) check(captured int, allstats map[string]interface{}) {
+	if c.bucket == nil {
+		return
+	}
+	if captured == 0 {
+		c.connect("no stats returned")
+		return
+	}
+	all, _ := allstats["all"].(map[string]map[string]interface{})
+	if n := servingNodes(c.bucket); len(all) < n {
+		log.Printf("Only got stats from %v of %v nodes, refreshing",
+			len(all), n)
+		c.refresh()
+	}
+}
+
+// Describe the cluster as this connection currently sees it, marking
+// what changed since the last time we looked and recording an event
+// document for each change.
+func (c *bucketConn) topology() *topology {
+	if c.bucket == nil {
+		return nil
+	}
+	t := getTopology(c.bucket)
+	t.markChanges(c.topo)
+	for _, e := range topologyEvents(c.topo, t) {
+		log.Printf("Topology %v %v", e.Event, e.Node)
+		c.record("topology", map[string]interface{}{
+			"event":  e.Event,
+			"node":   e.Node,
+			"before": e.Before,
+			"after":  e.After,
+		})
+	}
+	c.topo = t
+	return t
+}
+
+func (c *bucketConn) Close() {
+	if c.bucket != nil {
+		c.bucket.Close()
+		c.bucket = nil
+	}
+}
+
+// The set of buckets being captured.  When capturing all buckets,
+// the set is rediscovered from the pool every refresh interval.
+type bucketSet struct {
+	conns      map[string]*bucketConn
+	discovered time.Time
+
+	db    statstore.Storer
+	proto map[string]interface{}
+}
+
+func newBucketSet(db statstore.Storer,
+	proto map[string]interface{}) *bucketSet {
+
+	return &bucketSet{
+		conns: map[string]*bucketConn{},
+		db:    db,
+		proto: proto,
+	}
+}
+
+func (bs *bucketSet) add(name string) {
+	bs.conns[name] = &bucketConn{name: name, db: bs.db, proto: bs.proto}
+}
+
+func (bs *bucketSet) update() {
+	if !*allBuckets && *includeBuckets == "" {
+		if len(bs.conns) == 0 {
+			bs.add(*bucket)
+		}
+		return
+	}
+
+	if time.Since(bs.discovered) < *refreshTime {
+		return
+	}
+	names, err := discoverBuckets()
+	if err != nil {
+		log.Printf("Error discovering buckets: %v", err)
+		return
+	}
+	bs.discovered = time.Now()
+
+	want := map[string]bool{}
+	for _, name := range selectBuckets(names,
+		splitList(*includeBuckets), splitList(*excludeBuckets)) {
+
+		want[name] = true
+		if _, ok := bs.conns[name]; !ok {
+			log.Printf("Capturing bucket %v", name)
+			bs.add(name)
+		}
+	}
+	for name, c := range bs.conns {
+		if !want[name] {
+			c.Close()
+			c.event("removed", "bucket no longer in pool")
+			delete(bs.conns, name)
+		}
+	}
+}
+
+// The current bucket connections, ordered by name.
+func (bs *bucketSet) connections() []*bucketConn {
+	bs.update()
+
+	names := make([]string, 0, len(bs.conns))
+	for name := range bs.conns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rv := make([]*bucketConn, 0, len(names))
+	for _, name := range names {
+		rv = append(rv, bs.conns[name])
+	}
+	return rv
+}
+
+func (bs *bucketSet) Close() {
+	for _, c := range bs.conns {
+		c.Close()
+	}
+}
+
+func fetchOnce(client fetcher,
+	proto map[string]interface{}) (int, map[string]interface{}) {
 
 	allstats := map[string]interface{}{}
 
-	client := connect()
 	if client == nil {
 		log.Printf("Failed to establish connection")
 		return 0, allstats
 	}
-	defer client.Close()
 
 	for k, v := range proto {
 		allstats[k] = v
 	}
 	allstats["ts"] = time.Now()
-	allstats["bucket-data"] = client
+
+	average := splitList(*averageStats)
+	cluster := map[string]interface{}{}
 
 	all := getNumericStats(client, "")
 	captured := len(all)
 	allstats["all"] = all
+	cluster["all"] = aggregate(all, average)
 
 	if *additionalStats != "" {
 		additional := strings.Split(*additionalStats, ",")
@@ -93,9 +387,11 @@ func fetchOnce(proto map[string]interface{}) (int, map[string]interface{}) {
 			captured += len(st)
 			if len(st) > 0 {
 				allstats[name] = st
+				cluster[name] = aggregate(st, average)
 			}
 		}
 	}
+	allstats["cluster"] = cluster
 
 	return captured, allstats
 
@@ -110,13 +406,21 @@ func gatherStats(db statstore.Storer, proto map[string]interface{}) {
 
 	delay := time.Duration(*sleepTime) * time.Second
 
+	buckets := newBucketSet(db, proto)
+	defer buckets.Close()
+
 	for running {
-		captured, allstats := fetchOnce(proto)
+		for _, conn := range buckets.connections() {
+			captured, allstats := fetchOnce(conn.fetcher(), proto)
+			conn.check(captured, allstats)
 
-		if captured > 0 {
-			log.Printf("Captured %d stats", captured)
+			if captured > 0 {
+				log.Printf("Captured %d stats from %v", captured, conn.name)
 
-			go store(db, time.Now(), allstats)
+				allstats["bucket"] = conn.name
+				allstats["topology"] = conn.topology()
+				go store(db, time.Now(), allstats)
+			}
 		}
 
 		select {
@@ -132,11 +436,19 @@ func gatherStats(db statstore.Storer, proto map[string]interface{}) {
 func main() {
 	flag.Parse()
 
-	out, err := statstore.GetStorer(*outPath)
-	if err != nil {
-		log.Fatalf("Error creating storer: %v", err)
+	if err := loadCredentials(); err != nil {
+		log.Fatalf("Error loading credentials: %v", err)
+	}
+
+	mode := statstore.CreateNew
+	switch {
+	case *appendOut && *forceOut:
+		log.Fatalf("Can't both append and force overwriting")
+	case *appendOut:
+		mode = statstore.Append
+	case *forceOut:
+		mode = statstore.Overwrite
 	}
-	defer out.Close()
 
 	proto := map[string]interface{}{}
 	if *protoFile != "" {
@@ -150,6 +462,16 @@ func main() {
 		}
 	}
 
+	h := statstore.NewHeader()
+	h.Server = *server
+	h.Interval = (time.Duration(*sleepTime) * time.Second).String()
+	h.Proto = proto
+	out, err := statstore.GetStorerHeader(*outPath, mode, h)
+	if err != nil {
+		log.Fatalf("Error creating storer: %v", err)
+	}
+	defer out.Close()
+
 	log.Printf("Capturing %v to %v", *server, *outPath)
 
 	gatherStats(out, proto)
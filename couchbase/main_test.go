@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSelectBuckets(t *testing.T) {
+	names := []string{"beer-sample", "default", "sessions", "sessions-old"}
+
+	tests := []struct {
+		include, exclude string
+		exp              []string
+	}{
+		{"", "", names},
+		{"", "sessions*", []string{"beer-sample", "default"}},
+		{"default,beer*", "", []string{"beer-sample", "default"}},
+		{"sessions*", "*-old", []string{"sessions"}},
+		{"nothing", "", []string{}},
+	}
+
+	for _, test := range tests {
+		got := selectBuckets(names, splitList(test.include),
+			splitList(test.exclude))
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("include=%q exclude=%q: expected %v, got %v",
+				test.include, test.exclude, test.exp, got)
+		}
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	c := credentials{
+		BucketPassword: "common",
+		Buckets:        map[string]string{"sessions": "sekrit"},
+	}
+
+	if pw := c.bucketPassword("sessions"); pw != "sekrit" {
+		t.Errorf("Expected per-bucket password, got %q", pw)
+	}
+	if pw := c.bucketPassword("default"); pw != "common" {
+		t.Errorf("Expected common password, got %q", pw)
+	}
+
+	// Without an admin, REST gets the bucket's credentials.
+	a := c.auth("sessions")
+	if u, pw, b := a.GetCredentials(); u != "sessions" || pw != "sekrit" || b != "sessions" {
+		t.Errorf("Expected bucket credentials for REST, got %v/%v/%v", u, pw, b)
+	}
+
+	c.User, c.Password = "Administrator", "p@ss"
+	a = c.auth("sessions")
+	if u, pw, b := a.GetCredentials(); u != "Administrator" || pw != "p@ss" || b != "sessions" {
+		t.Errorf("Expected admin credentials for REST, got %v/%v/%v", u, pw, b)
+	}
+	if u, pw := a.GetSaslCredentials(); u != "sessions" || pw != "sekrit" {
+		t.Errorf("Expected bucket credentials for SASL, got %v/%v", u, pw)
+	}
+}
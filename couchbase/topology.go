@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/couchbaselabs/go-couchbase"
+)
+
+// A node as seen in the cluster map.
+type nodeInfo struct {
+	Hostname   string   `json:"hostname"`
+	Server     string   `json:"server,omitempty"`
+	Status     string   `json:"status"`
+	Membership string   `json:"membership"`
+	Services   []string `json:"services,omitempty"`
+	Version    string   `json:"version,omitempty"`
+
+	ActiveVBuckets  int `json:"active_vbuckets"`
+	ReplicaVBuckets int `json:"replica_vbuckets"`
+}
+
+// The parts of the cluster map worth keeping with each sample.
+type topology struct {
+	Nodes     []nodeInfo `json:"nodes"`
+	Replicas  int        `json:"replicas"`
+	VBuckets  int        `json:"vbuckets"`
+	VBMapHash string     `json:"vbmap_hash"`
+
+	// Which of nodes, replicas and vbmap changed since the
+	// previous sample.
+	Changed []string `json:"changed,omitempty"`
+}
+
+// The memcached address of a node, as it appears in the vbucket
+// server list.
+func nodeServer(n couchbase.Node) string {
+	port, ok := n.Ports["direct"]
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(n.Hostname)
+	if err != nil {
+		host = n.Hostname
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func hashVBMap(m *couchbase.VBucketServerMap) string {
+	h := sha1.New()
+	json.NewEncoder(h).Encode([]interface{}{m.ServerList, m.VBucketMap})
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func getTopology(b *couchbase.Bucket) *topology {
+	vbm := b.VBServerMap()
+
+	active := map[string]int{}
+	replica := map[string]int{}
+	for _, chain := range vbm.VBucketMap {
+		for i, idx := range chain {
+			if idx < 0 || idx >= len(vbm.ServerList) {
+				continue
+			}
+			if i == 0 {
+				active[vbm.ServerList[idx]]++
+			} else {
+				replica[vbm.ServerList[idx]]++
+			}
+		}
+	}
+
+	rv := &topology{
+		Replicas:  vbm.NumReplicas,
+		VBuckets:  len(vbm.VBucketMap),
+		VBMapHash: hashVBMap(vbm),
+	}
+	for _, n := range b.Nodes() {
+		server := nodeServer(n)
+		rv.Nodes = append(rv.Nodes, nodeInfo{
+			Hostname:        n.Hostname,
+			Server:          server,
+			Status:          n.Status,
+			Membership:      n.ClusterMembership,
+			Services:        n.Services,
+			Version:         n.Version,
+			ActiveVBuckets:  active[server],
+			ReplicaVBuckets: replica[server],
+		})
+	}
+	return rv
+}
+
+// How many nodes we should be getting stats from.  Failed over nodes
+// stay in the list until they're rebalanced out, and unhealthy ones
+// don't answer, so neither means the cluster map is stale.
+func servingNodes(b *couchbase.Bucket) int {
+	rv := 0
+	for _, n := range b.Nodes() {
+		if n.ClusterMembership == "active" && n.Status == "healthy" {
+			rv++
+		}
+	}
+	return rv
+}
+
+// Node identity and health, without the vbucket counts (which are
+// covered by the vbucket map hash).
+func (t *topology) nodeStates() map[string]nodeInfo {
+	rv := map[string]nodeInfo{}
+	for _, n := range t.Nodes {
+		n.ActiveVBuckets, n.ReplicaVBuckets = 0, 0
+		rv[n.Hostname] = n
+	}
+	return rv
+}
+
+// Mark what changed since prev.
+func (t *topology) markChanges(prev *topology) {
+	t.Changed = nil
+	if prev == nil {
+		return
+	}
+	if !reflect.DeepEqual(t.nodeStates(), prev.nodeStates()) {
+		t.Changed = append(t.Changed, "nodes")
+	}
+	if t.Replicas != prev.Replicas {
+		t.Changed = append(t.Changed, "replicas")
+	}
+	if t.VBMapHash != prev.VBMapHash {
+		t.Changed = append(t.Changed, "vbmap")
+	}
+}
+
+// A change in cluster topology between two samples.
+type topologyEvent struct {
+	Event  string      `json:"event"`
+	Node   string      `json:"node,omitempty"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Per-node vbucket counts, for describing vbucket map moves.
+type vbCounts struct {
+	Active  int `json:"active"`
+	Replica int `json:"replica"`
+}
+
+type vbMapState struct {
+	Hash  string              `json:"hash"`
+	Nodes map[string]vbCounts `json:"nodes"`
+}
+
+func (t *topology) vbState() vbMapState {
+	rv := vbMapState{Hash: t.VBMapHash, Nodes: map[string]vbCounts{}}
+	for _, n := range t.Nodes {
+		rv.Nodes[n.Hostname] = vbCounts{n.ActiveVBuckets, n.ReplicaVBuckets}
+	}
+	return rv
+}
+
+// Describe everything that changed between two topologies: nodes
+// joining or leaving, node health or membership changes (including
+// failover), and vbucket map moves (rebalance).
+func topologyEvents(prev, cur *topology) []topologyEvent {
+	if prev == nil || cur == nil {
+		return nil
+	}
+
+	rv := []topologyEvent{}
+	before, after := prev.nodeStates(), cur.nodeStates()
+
+	hosts := []string{}
+	for h := range before {
+		hosts = append(hosts, h)
+	}
+	for h := range after {
+		if _, ok := before[h]; !ok {
+			hosts = append(hosts, h)
+		}
+	}
+	sort.Strings(hosts)
+
+	for _, h := range hosts {
+		b, hadB := before[h]
+		a, hasA := after[h]
+		switch {
+		case !hadB:
+			rv = append(rv, topologyEvent{"node-added", h, nil, a})
+		case !hasA:
+			rv = append(rv, topologyEvent{"node-removed", h, b, nil})
+		case a.Membership == "inactiveFailed" &&
+			b.Membership != "inactiveFailed":
+			rv = append(rv, topologyEvent{"failover", h, b, a})
+		case !reflect.DeepEqual(a, b):
+			rv = append(rv, topologyEvent{"node-changed", h, b, a})
+		}
+	}
+
+	if prev.Replicas != cur.Replicas {
+		rv = append(rv, topologyEvent{"replicas-changed", "",
+			prev.Replicas, cur.Replicas})
+	}
+	if prev.VBMapHash != cur.VBMapHash {
+		rv = append(rv, topologyEvent{"vbmap-changed", "",
+			prev.vbState(), cur.vbState()})
+	}
+	return rv
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/couchbaselabs/go-couchbase"
+)
+
+func testBucket() *couchbase.Bucket {
+	b := &couchbase.Bucket{
+		Name: "default",
+		NodesJSON: []couchbase.Node{
+			{Hostname: "a:8091", Status: "healthy",
+				ClusterMembership: "active",
+				Ports:             map[string]int{"direct": 11210}},
+			{Hostname: "b:8091", Status: "healthy",
+				ClusterMembership: "active",
+				Ports:             map[string]int{"direct": 11210}},
+		},
+	}
+	b.VBucketServerMap.NumReplicas = 1
+	b.VBucketServerMap.ServerList = []string{"a:11210", "b:11210"}
+	b.VBucketServerMap.VBucketMap = [][]int{
+		{0, 1}, {0, 1}, {1, 0}, {1, -1},
+	}
+	return b
+}
+
+func TestGetTopology(t *testing.T) {
+	topo := getTopology(testBucket())
+
+	if topo.Replicas != 1 || topo.VBuckets != 4 || topo.VBMapHash == "" {
+		t.Fatalf("Unexpected topology: %+v", topo)
+	}
+
+	counts := [][]int{}
+	for _, n := range topo.Nodes {
+		counts = append(counts, []int{n.ActiveVBuckets, n.ReplicaVBuckets})
+	}
+	if !reflect.DeepEqual(counts, [][]int{{2, 1}, {2, 2}}) {
+		t.Fatalf("Unexpected vbucket counts: %v", counts)
+	}
+}
+
+func TestTopologyChanges(t *testing.T) {
+	b := testBucket()
+	first := getTopology(b)
+	first.markChanges(nil)
+	if first.Changed != nil {
+		t.Fatalf("First topology shouldn't have changes: %v", first.Changed)
+	}
+
+	same := getTopology(b)
+	same.markChanges(first)
+	if same.Changed != nil {
+		t.Fatalf("Expected no changes, got %v", same.Changed)
+	}
+
+	b.NodesJSON[1].Status = "unhealthy"
+	b.VBucketServerMap.VBucketMap[3] = []int{0, -1}
+	moved := getTopology(b)
+	moved.markChanges(same)
+	if !reflect.DeepEqual(moved.Changed, []string{"nodes", "vbmap"}) {
+		t.Fatalf("Expected nodes and vbmap changes, got %v", moved.Changed)
+	}
+}
+
+func TestTopologyEvents(t *testing.T) {
+	b := testBucket()
+	prev := getTopology(b)
+
+	if evs := topologyEvents(nil, prev); len(evs) != 0 {
+		t.Fatalf("Expected no events without a previous topology: %v", evs)
+	}
+	if evs := topologyEvents(prev, getTopology(b)); len(evs) != 0 {
+		t.Fatalf("Expected no events for the same topology: %v", evs)
+	}
+
+	b.NodesJSON[1].ClusterMembership = "inactiveFailed"
+	b.NodesJSON = append(b.NodesJSON, couchbase.Node{Hostname: "c:8091",
+		Status: "healthy", ClusterMembership: "inactiveAdded"})
+	b.VBucketServerMap.VBucketMap[2] = []int{0, -1}
+	b.VBucketServerMap.VBucketMap[3] = []int{0, -1}
+
+	evs := topologyEvents(prev, getTopology(b))
+	got := []string{}
+	for _, e := range evs {
+		got = append(got, e.Event+" "+e.Node)
+	}
+	exp := []string{"failover b:8091", "node-added c:8091", "vbmap-changed "}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("Expected events %v, got %v", exp, got)
+	}
+
+	vb := evs[2].After.(vbMapState)
+	if vb.Nodes["a:8091"].Active != 4 || vb.Hash == prev.VBMapHash {
+		t.Fatalf("Unexpected vbmap state after move: %+v", vb)
+	}
+}
+
+func TestServingNodes(t *testing.T) {
+	b := testBucket()
+	if n := servingNodes(b); n != 2 {
+		t.Fatalf("Expected 2 serving nodes, got %v", n)
+	}
+	b.NodesJSON[1].ClusterMembership = "inactiveFailed"
+	b.NodesJSON = append(b.NodesJSON,
+		couchbase.Node{Hostname: "c:8091", Status: "unhealthy",
+			ClusterMembership: "active"},
+		couchbase.Node{Hostname: "d:8091", Status: "healthy",
+			ClusterMembership: "inactiveAdded"})
+	if n := servingNodes(b); n != 1 {
+		t.Fatalf("Expected 1 serving node, got %v", n)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/dustin/statcap/statstore"
+)
+
+var identityFile = flag.String("identity", "statcap.key",
+	"Where to write the secret identity (keep this at home)")
+var recipientFile = flag.String("recipient", "statcap.pub",
+	"Where to write the public key (give this to capture hosts)")
+
+func maybefatal(str string, err error) {
+	if err != nil {
+		log.Fatalf("%s: %v", str, err)
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	id, err := statstore.GenerateIdentity()
+	maybefatal("Error generating identity", err)
+
+	f, err := os.OpenFile(*identityFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		0600)
+	maybefatal("Error creating identity file", err)
+	fmt.Fprintf(f, "# recipient: %v\n%v\n", id.Recipient(), id)
+	maybefatal("Error writing identity file", f.Close())
+
+	err = os.WriteFile(*recipientFile,
+		[]byte(id.Recipient().String()+"\n"), 0644)
+	maybefatal("Error writing recipient file", err)
+
+	log.Printf("Wrote %v and %v", *identityFile, *recipientFile)
+}
@@ -1,16 +1,17 @@
 package main
 
 import (
-	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"flag"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
-	"code.google.com/p/dsallings-couch-go"
+	"github.com/dustin/statcap/statstore"
 )
 
 var couchUrl *string = flag.String("couch", "http://localhost:5984/stats",
@@ -19,11 +20,18 @@ var protoFile *string = flag.String("proto", "",
 	"Proto document, into which timings stats will be added")
 var forceProto *bool = flag.Bool("forceProto", false,
 	"If true, proto will override document-specified fields")
+var caFile = flag.String("cacert", "", "CA certificates for https couch")
+var certFile = flag.String("cert", "", "Client certificate for https couch")
+var keyFile = flag.String("key", "", "Client key for https couch")
+var insecure = flag.Bool("insecure", false,
+	"Don't verify the https couch server certificate")
+
+var batchSize = flag.Int("batch", 500, "Documents per _bulk_docs request")
 
 var wg = sync.WaitGroup{}
 var proto map[string]interface{}
 
-func recordOne(db *couch.Database, m map[string]interface{}) {
+func recordOne(w statstore.Storer, m map[string]interface{}) {
 	defer wg.Done()
 
 	// Let us first apply the proto
@@ -33,19 +41,21 @@ func recordOne(db *couch.Database, m map[string]interface{}) {
 		}
 	}
 
-	_, _, err := db.Insert(m)
+	ts, err := statstore.ParseTimestamp(m["ts"])
 	if err != nil {
-		log.Printf("Error inserting %v\n%v", m, err)
+		log.Printf("Skipping document: %v", err)
+		return
 	}
-}
 
-func record(ch <-chan map[string]interface{}) {
-	db, err := couch.Connect(*couchUrl)
+	_, _, err = w.Insert(statstore.NewItem(m, ts))
 	if err != nil {
-		log.Fatalf("Error connecting to couchdb: %v", err)
+		log.Printf("Error inserting batch ending with %v\n%v", m["ts"], err)
 	}
+}
+
+func record(w statstore.Storer, ch <-chan map[string]interface{}) {
 	for m := range ch {
-		recordOne(&db, m)
+		recordOne(w, m)
 	}
 }
 
@@ -72,35 +82,73 @@ func main() {
 		os.Exit(1)
 	}
 	filename := flag.Arg(0)
-	f, err := os.Open(filename)
+	r, err := statstore.GetStoreReader(filename)
 	if err != nil {
-		log.Fatalf("Error opening input file: %v", err)
+		log.Fatalf("Error opening input: %v", err)
 	}
-	defer f.Close()
+	defer r.Close()
 
-	zr, err := gzip.NewReader(f)
+	loadProto()
+
+	db, err := statstore.OpenCouchDB(*couchUrl, &statstore.TLSOptions{
+		CAFile:   *caFile,
+		CertFile: *certFile,
+		KeyFile:  *keyFile,
+		Insecure: *insecure,
+	})
 	if err != nil {
-		log.Fatalf("Error making gzip reader: %v", err)
+		log.Fatalf("Error connecting to couchdb: %v", err)
 	}
-	d := json.NewDecoder(zr)
-
-	loadProto()
+	// Document IDs include the file name so loading the same file
+	// twice doesn't duplicate anything.
+	w := statstore.NewCouchStorer(db, statstore.BatchOptions{
+		Size:   *batchSize,
+		Source: filepath.Base(filename),
+	})
 
 	ch := make(chan map[string]interface{}, 10)
 
 	for i := 0; i < 4; i++ {
-		go record(ch)
+		go record(w, ch)
 	}
 
 	written := 0
+	lastErr := ""
 	for {
-		m := map[string]interface{}{}
-		err = d.Decode(&m)
+		it, err := r.Next()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			if err == io.EOF {
+			// Damaged records are reported as they're met, but a
+			// reader that can't get past one repeats it.
+			if err.Error() == lastErr || errors.Is(err, statstore.ErrTruncated) {
+				log.Printf("Error reading an entry, stopping: %v", err)
 				break
 			}
-			log.Fatalf("Error decoding stuff: %v", err)
+			lastErr = err.Error()
+			log.Printf("Skipping an entry: %v", err)
+			continue
+		}
+		lastErr = ""
+		ts, err := it.TimestampE()
+		if err != nil {
+			log.Printf("Skipping an entry: %v", err)
+			continue
+		}
+		doc, err := it.Map()
+		if err != nil {
+			log.Printf("Skipping an entry: %v", err)
+			continue
+		}
+		// The decoded item is shared, and the proto is applied to
+		// our copy.  Zip entries keep their time outside the document.
+		m := make(map[string]interface{}, len(doc)+1)
+		for k, v := range doc {
+			m[k] = v
+		}
+		if _, ok := m["ts"]; !ok {
+			m["ts"] = ts
 		}
 		wg.Add(1)
 		ch <- m
@@ -111,5 +159,8 @@ func main() {
 
 	wg.Wait()
 	close(ch)
+	if err := w.Close(); err != nil {
+		log.Printf("Error storing the last batch: %v", err)
+	}
 	log.Printf("Completed storage in a total of %v", time.Now().Sub(start))
 }
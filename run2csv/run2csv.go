@@ -7,11 +7,16 @@ import (
 	"log"
 	"os"
 
-	"code.google.com/p/dsallings-couch-go"
+	"github.com/dustin/statcap/statstore"
 )
 
 var couchUrl *string = flag.String("couch", "http://localhost:5984/stats",
 	"Couch DB.")
+var caFile = flag.String("cacert", "", "CA certificates for https couch")
+var certFile = flag.String("cert", "", "Client certificate for https couch")
+var keyFile = flag.String("key", "", "Client key for https couch")
+var insecure = flag.Bool("insecure", false,
+	"Don't verify the https couch server certificate")
 
 type ResultRow struct {
 	Key   []interface{}
@@ -28,7 +33,7 @@ func maybefatal(str string, err error) {
 	}
 }
 
-func getResults(db couch.Database, run, which string) {
+func getResults(db *statstore.CouchDB, run, which string) {
 	query_results := Results{}
 
 	err := db.Query("_design/statdata/_view/"+which,
@@ -70,7 +75,7 @@ func getResults(db couch.Database, run, which string) {
 	}
 }
 
-func listRuns(db *couch.Database) {
+func listRuns(db *statstore.CouchDB) {
 	query_results := Results{}
 
 	err := db.Query("_design/statdata/_view/timings",
@@ -89,13 +94,18 @@ func listRuns(db *couch.Database) {
 func main() {
 	flag.Parse()
 
-	db, err := couch.Connect(*couchUrl)
+	db, err := statstore.OpenCouchDB(*couchUrl, &statstore.TLSOptions{
+		CAFile:   *caFile,
+		CertFile: *certFile,
+		KeyFile:  *keyFile,
+		Insecure: *insecure,
+	})
 	maybefatal("Error connecting to couchdb", err)
 
 	if flag.NArg() < 1 {
 		log.Printf("Need the name of the run to grab.")
 		flag.Usage()
-		listRuns(&db)
+		listRuns(db)
 		os.Exit(1)
 	}
 	run := flag.Arg(0)
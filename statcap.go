@@ -21,6 +21,10 @@ var server *string = flag.String("server", "localhost:11211",
 	"memcached server to connect to")
 var outPath *string = flag.String("out", "http://localhost:5984/stats",
 	"http://couch.db/path or a /file/path")
+var appendOut = flag.Bool("append", false,
+	"Append to an existing -out file instead of refusing to start")
+var forceOut = flag.Bool("force", false,
+	"Overwrite an existing -out file instead of refusing to start")
 var protoFile *string = flag.String("proto", "",
 	"Proto document, into which timings stats will be added")
 var additionalStats *string = flag.String("stats", "timings,kvtimings",
@@ -91,7 +95,7 @@ func fetchOnce(client fetcher,
 }
 
 func gatherStats(client fetcher, db statstore.Storer,
-	proto map[string]interface{}) {
+	proto map[string]interface{}, alerts *alerter) {
 
 	running := true
 
@@ -108,6 +112,7 @@ func gatherStats(client fetcher, db statstore.Storer,
 		if captured > 0 {
 			log.Printf("Captured %d stats", captured)
 
+			alerts.evaluate(allstats)
 			go store(db, time.Now(), allstats)
 		} else {
 			if client != nil {
@@ -127,9 +132,44 @@ func gatherStats(client fetcher, db statstore.Storer,
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify":
+			os.Exit(verifyMain(os.Args[2:], os.Stdout))
+		case "compact":
+			os.Exit(compactMain(os.Args[2:], os.Stdout))
+		}
+	}
+
 	flag.Parse()
 
-	out, err := statstore.GetStorer(*outPath)
+	mode := statstore.CreateNew
+	switch {
+	case *appendOut && *forceOut:
+		log.Fatalf("Can't both append and force overwriting")
+	case *appendOut:
+		mode = statstore.Append
+	case *forceOut:
+		mode = statstore.Overwrite
+	}
+
+	proto := map[string]interface{}{}
+	if *protoFile != "" {
+		f, err := os.Open(*protoFile)
+		if err != nil {
+			log.Fatalf("Error opening proto file:  %v", err)
+		}
+		err = json.NewDecoder(f).Decode(&proto)
+		if err != nil {
+			log.Fatalf("Error parsing proto: %v", err)
+		}
+	}
+
+	h := statstore.NewHeader()
+	h.Server = *server
+	h.Interval = sleepTime.String()
+	h.Proto = proto
+	out, err := statstore.GetStorerHeader(*outPath, mode, h)
 	if err != nil {
 		log.Fatalf("Error creating storer: %v", err)
 	}
@@ -141,17 +181,13 @@ func main() {
 	}
 	defer client.Close()
 
-	proto := map[string]interface{}{}
-	if *protoFile != "" {
-		f, err := os.Open(*protoFile)
-		if err != nil {
-			log.Fatalf("Error opening proto file:  %v", err)
-		}
-		err = json.NewDecoder(f).Decode(&proto)
+	var alerts *alerter
+	if *alertsFile != "" {
+		alerts, err = loadAlerter(*alertsFile, out, proto)
 		if err != nil {
-			log.Fatalf("Error parsing proto: %v", err)
+			log.Fatalf("Error loading alert rules: %v", err)
 		}
 	}
 
-	gatherStats(client, out, proto)
+	gatherStats(client, out, proto, alerts)
 }
@@ -0,0 +1,116 @@
+package statstore
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type decodedItem struct {
+	m   map[string]interface{}
+	err error
+}
+
+// The item as a map of generic JSON values.  Items from NewItem go
+// through JSON too, so values have the same types (float64 numbers,
+// nested maps) however the item was made.  The result is cached and
+// shared, so it mustn't be modified.
+func (s *StoredItem) Map() (map[string]interface{}, error) {
+	if s.decoded == nil {
+		d := &decodedItem{}
+		b, err := s.MarshalJSON()
+		if err == nil {
+			err = json.Unmarshal(b, &d.m)
+		}
+		d.err = err
+		s.decoded = d
+	}
+	return s.decoded.m, s.decoded.err
+}
+
+// Find the value at path in m.  Keys can have dots in them (server
+// names, for instance), so the longest key matching the front of the
+// path wins.
+func lookupPath(m map[string]interface{}, path string) (interface{}, bool) {
+	if v, ok := m[path]; ok {
+		return v, true
+	}
+	for i := len(path) - 1; i > 0; i-- {
+		if path[i] != '.' {
+			continue
+		}
+		if sub, ok := m[path[:i]].(map[string]interface{}); ok {
+			if v, ok := lookupPath(sub, path[i+1:]); ok {
+				return v, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// The value at a dotted path such as "all.curr_items".
+func (s *StoredItem) Get(path string) (interface{}, bool) {
+	m, err := s.Map()
+	if err != nil {
+		return nil, false
+	}
+	return lookupPath(m, path)
+}
+
+// The number at a dotted path.  Numeric strings count.
+func (s *StoredItem) Float(path string) (float64, bool) {
+	v, _ := s.Get(path)
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// The string at a dotted path.
+func (s *StoredItem) String(path string) (string, bool) {
+	v, _ := s.Get(path)
+	x, ok := v.(string)
+	return x, ok
+}
+
+func sortedKeys(m map[string]interface{}, groups bool) []string {
+	rv := []string{}
+	for k, v := range m {
+		if _, isMap := v.(map[string]interface{}); isMap || !groups {
+			rv = append(rv, k)
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// The names in the group (e.g. "timings") at a dotted path, sorted.
+// An empty path gives the item's top level names.
+func (s *StoredItem) Keys(group string) []string {
+	m, err := s.Map()
+	if err != nil {
+		return nil
+	}
+	if group != "" {
+		v, _ := lookupPath(m, group)
+		if m, _ = v.(map[string]interface{}); m == nil {
+			return nil
+		}
+	}
+	return sortedKeys(m, false)
+}
+
+// The names of the item's stat groups (top level values that are
+// themselves groups of stats, such as "all"), sorted.
+func (s *StoredItem) Groups() []string {
+	m, err := s.Map()
+	if err != nil {
+		return nil
+	}
+	return sortedKeys(m, true)
+}
@@ -0,0 +1,107 @@
+package statstore
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func testItems(t *testing.T) map[string]StoredItem {
+	doc := map[string]interface{}{
+		"all": map[string]interface{}{
+			"curr_items": 1848.0,
+			"version":    "1.4.5",
+			"threads":    "4",
+		},
+		"timings": map[string]interface{}{
+			"cmd_get_8,16": 3.0,
+		},
+		"nodes": map[string]interface{}{
+			"10.0.0.1:8091": map[string]interface{}{"status": "healthy"},
+		},
+		"name": "run42",
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	fromJSON := StoredItem{}
+	if err := json.Unmarshal(b, &fromJSON); err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+
+	// Values that aren't what JSON would give back.
+	doc["all"].(map[string]interface{})["curr_items"] = 1848
+	return map[string]StoredItem{
+		"rawI": NewItem(doc, basetime),
+		"rawJ": fromJSON,
+	}
+}
+
+func TestItemAccessors(t *testing.T) {
+	for name, it := range testItems(t) {
+		if f, ok := it.Float("all.curr_items"); !ok || f != 1848 {
+			t.Errorf("%v: curr_items = %v/%v", name, f, ok)
+		}
+		if f, ok := it.Float("all.threads"); !ok || f != 4 {
+			t.Errorf("%v: threads = %v/%v", name, f, ok)
+		}
+		if f, ok := it.Float("timings.cmd_get_8,16"); !ok || f != 3 {
+			t.Errorf("%v: cmd_get_8,16 = %v/%v", name, f, ok)
+		}
+		for _, path := range []string{"all.version", "all.missing",
+			"missing.curr_items", "name.x", ""} {
+			if f, ok := it.Float(path); ok {
+				t.Errorf("%v: expected no number at %q, got %v", name, path, f)
+			}
+		}
+
+		if s, ok := it.String("all.version"); !ok || s != "1.4.5" {
+			t.Errorf("%v: version = %v/%v", name, s, ok)
+		}
+		if s, ok := it.String("nodes.10.0.0.1:8091.status"); !ok || s != "healthy" {
+			t.Errorf("%v: node status = %v/%v", name, s, ok)
+		}
+		if _, ok := it.String("all.curr_items"); ok {
+			t.Errorf("%v: curr_items shouldn't be a string", name)
+		}
+
+		if k := it.Keys("all"); !reflect.DeepEqual(k,
+			[]string{"curr_items", "threads", "version"}) {
+			t.Errorf("%v: keys of all = %v", name, k)
+		}
+		if k := it.Keys(""); !reflect.DeepEqual(k,
+			[]string{"all", "name", "nodes", "timings"}) {
+			t.Errorf("%v: top level keys = %v", name, k)
+		}
+		if k := it.Keys("name"); k != nil {
+			t.Errorf("%v: expected no keys for a string, got %v", name, k)
+		}
+		if g := it.Groups(); !reflect.DeepEqual(g,
+			[]string{"all", "nodes", "timings"}) {
+			t.Errorf("%v: groups = %v", name, g)
+		}
+
+		// Decoded once.
+		m1, _ := it.Map()
+		m2, _ := it.Map()
+		if reflect.ValueOf(m1).Pointer() != reflect.ValueOf(m2).Pointer() {
+			t.Errorf("%v: item was decoded twice", name)
+		}
+	}
+}
+
+func TestItemAccessorsBadJSON(t *testing.T) {
+	rm := json.RawMessage(`{"all": `)
+	it := StoredItem{rawJ: &rm}
+	if _, err := it.Map(); err == nil {
+		t.Fatalf("Expected an error decoding bad JSON")
+	}
+	if _, ok := it.Float("all.x"); ok {
+		t.Fatalf("Expected no value from bad JSON")
+	}
+	if it.Groups() != nil {
+		t.Fatalf("Expected no groups from bad JSON")
+	}
+}
@@ -0,0 +1,446 @@
+package statstore
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Write the test server's certificate where a cacert option can
+// find it.
+func writeServerCA(t *testing.T, srv *httptest.Server) string {
+	f, err := os.CreateTemp("", "statstore-ca")
+	if err != nil {
+		t.Fatalf("Error creating CA file: %v", err)
+	}
+	defer f.Close()
+	err = pem.Encode(f, &pem.Block{Type: "CERTIFICATE",
+		Bytes: srv.Certificate().Raw})
+	if err != nil {
+		t.Fatalf("Error writing CA file: %v", err)
+	}
+	return f.Name()
+}
+
+func TestHTTPSCouchStorer(t *testing.T) {
+	docs := make(chan map[string]interface{}, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		if req.Method != "POST" || req.URL.Path != "/stats/_bulk_docs" {
+			t.Errorf("Unexpected request: %v %v", req.Method, req.URL)
+		}
+		if u, p, _ := req.BasicAuth(); u != "me" || p != "pw" {
+			t.Errorf("Expected basic auth, got %q/%q", u, p)
+		}
+		m := struct {
+			Docs []map[string]interface{}
+		}{}
+		json.NewDecoder(req.Body).Decode(&m)
+		docs <- m.Docs[0]
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode([]BulkResult{{ID: m.Docs[0]["_id"].(string),
+			Rev: "1-x"}})
+	}))
+	defer srv.Close()
+
+	ca := writeServerCA(t, srv)
+	defer os.Remove(ca)
+
+	u := "https://me:pw@" + srv.Listener.Addr().String() + "/stats"
+
+	fs, err := GetStorer(u)
+	if err != nil {
+		t.Fatalf("Error opening storer: %v", err)
+	}
+	if _, _, err := fs.Insert(NewItem(map[string]interface{}{"a": "ayyy"},
+		basetime)); err == nil {
+		t.Fatalf("Expected an error with an untrusted certificate")
+	}
+
+	fs, err = GetStorer(u + "?cacert=" + ca)
+	if err != nil {
+		t.Fatalf("Error opening storer with CA: %v", err)
+	}
+	id, rev, err := fs.Insert(NewItem(map[string]interface{}{"a": "ayyy"},
+		basetime))
+	if err != nil {
+		t.Fatalf("Error inserting: %v", err)
+	}
+	if id == "" || rev != "1-x" {
+		t.Fatalf("Expected an id and rev 1-x, got %v/%v", id, rev)
+	}
+	if m := <-docs; m["a"] != "ayyy" || m["_id"] != id {
+		t.Fatalf("Didn't store the document: %v", m)
+	}
+}
+
+func TestCouchError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+		w.WriteHeader(401)
+		w.Write([]byte(`{"error":"unauthorized","reason":"nope"}`))
+	}))
+	defer srv.Close()
+
+	db, err := OpenCouchDB(srv.URL+"/stats", nil)
+	if err != nil {
+		t.Fatalf("Error opening db: %v", err)
+	}
+	_, _, err = db.Insert(map[string]interface{}{})
+	if err == nil || err.Error() != "401 Unauthorized: unauthorized: nope" {
+		t.Fatalf("Expected an unauthorized error, got %v", err)
+	}
+}
+
+// Just enough of CouchDB to page through our views and take
+// _bulk_docs.
+type fakeCouch struct {
+	t      *testing.T
+	design map[string]interface{}
+	docs   []map[string]interface{}
+	// Rows returned from views.
+	rows int
+	// Refuse to change the design doc.
+	readOnly bool
+
+	lock     sync.Mutex
+	bulk     map[string]map[string]interface{}
+	requests int
+}
+
+func (f *fakeCouch) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == "/stats/"+couchDesignDoc && req.Method == "GET":
+		if f.design == nil {
+			w.WriteHeader(404)
+			w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(f.design)
+	case req.URL.Path == "/stats/"+couchDesignDoc && req.Method == "PUT" && f.readOnly:
+		w.WriteHeader(403)
+		w.Write([]byte(`{"error":"forbidden","reason":"admins only"}`))
+	case req.URL.Path == "/stats/"+couchDesignDoc && req.Method == "PUT":
+		f.design = map[string]interface{}{}
+		json.NewDecoder(req.Body).Decode(&f.design)
+		f.design["_rev"] = "1-x"
+		w.WriteHeader(201)
+		w.Write([]byte(`{"ok":true}`))
+	case req.URL.Path == "/stats/"+couchTSView:
+		f.view(w, req, false)
+	case req.URL.Path == "/stats/"+couchFieldView:
+		f.view(w, req, true)
+	case req.URL.Path == "/stats/_bulk_docs" && req.Method == "POST":
+		f.bulkDocs(w, req)
+	default:
+		f.t.Errorf("Unexpected request: %v %v", req.Method, req.URL)
+		w.WriteHeader(500)
+	}
+}
+
+// Serve by_ts, or by_field_ts (where keys must have the same field
+// and value at both ends).
+func (f *fakeCouch) view(w http.ResponseWriter, req *http.Request, byField bool) {
+	q := req.URL.Query()
+	var field, value string
+	param := func(k string) (rv float64, ok bool) {
+		if q.Get(k) == "" {
+			return 0, false
+		}
+		if !byField {
+			json.Unmarshal([]byte(q.Get(k)), &rv)
+			return rv, true
+		}
+		key := []interface{}{}
+		json.Unmarshal([]byte(q.Get(k)), &key)
+		field, value = key[0].(string), key[1].(string)
+		if len(key) < 3 {
+			return 0, false
+		}
+		rv, ok = key[2].(float64)
+		return rv, ok
+	}
+	start, hasStart := param("startkey")
+	end, hasEnd := param("endkey")
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	startID := ""
+	json.Unmarshal([]byte(q.Get("startkey_docid")), &startID)
+
+	rows := []map[string]interface{}{}
+	for _, d := range f.docs {
+		key := float64(d["key"].(int64))
+		doc := d["doc"].(map[string]interface{})
+		if byField && fmt.Sprint(doc[field]) != value {
+			continue
+		}
+		if hasStart && (key < start ||
+			(key == start && d["_id"].(string) < startID)) {
+			continue
+		}
+		if hasEnd && key >= end {
+			continue
+		}
+		if len(rows) == limit {
+			break
+		}
+		var rowKey interface{} = key
+		if byField {
+			rowKey = []interface{}{field, value, key}
+		}
+		rows = append(rows, map[string]interface{}{
+			"id": d["_id"], "key": rowKey, "doc": d["doc"],
+		})
+	}
+	f.rows += len(rows)
+	json.NewEncoder(w).Encode(map[string]interface{}{"rows": rows})
+}
+
+func newFakeCouch(t *testing.T, n int) *fakeCouch {
+	f := &fakeCouch{t: t}
+	for i := 0; i < n; i++ {
+		ts := basetime.Add(time.Duration(i) * time.Second)
+		id := fmt.Sprintf("doc%03d", i)
+		f.docs = append(f.docs, map[string]interface{}{
+			"_id": id,
+			"key": ts.UnixNano() / int64(time.Millisecond),
+			"doc": map[string]interface{}{
+				"_id": id, "_rev": "1-x", "ts": ts,
+				"name": fmt.Sprintf("run%d", i%2), "i": i,
+			},
+		})
+	}
+	return f
+}
+
+func TestCouchReader(t *testing.T) {
+	f := newFakeCouch(t, 10)
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	tests := []struct {
+		query string
+		exp   []int
+	}{
+		{"?page=3", []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		{"?page=2&field=name&value=run1", []int{1, 3, 5, 7, 9}},
+		{"?page=2&field=i&value=4", []int{4}},
+		{"?field=name&value=run0&from=" +
+			basetime.Add(3*time.Second).Format(time.RFC3339) + "&to=" +
+			basetime.Add(8*time.Second).Format(time.RFC3339), []int{4, 6}},
+		{"?page=4&from=" + basetime.Add(2*time.Second).Format(time.RFC3339) +
+			"&to=" + basetime.Add(5*time.Second).UTC().Format(time.RFC3339),
+			[]int{2, 3, 4}},
+	}
+
+	for _, test := range tests {
+		f.rows = 0
+		r, err := GetStoreReader(srv.URL + "/stats" + test.query)
+		if err != nil {
+			t.Fatalf("Error opening reader: %v", err)
+		}
+		got := []int{}
+		for {
+			it, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Error reading %v: %v", test.query, err)
+			}
+			m := map[string]interface{}{}
+			it.UnmarshalInto(&m)
+			if _, ok := m["_rev"]; ok {
+				t.Fatalf("Couch fields weren't removed: %v", m)
+			}
+			i := int(m["i"].(float64))
+			if !it.Timestamp().Equal(basetime.Add(time.Duration(i) * time.Second)) {
+				t.Fatalf("Wrong timestamp for %v: %v", i, it.Timestamp())
+			}
+			got = append(got, i)
+		}
+		r.Close()
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%v: expected %v, got %v", test.query, test.exp, got)
+		}
+		// Filtering by field is done by the view, not by fetching
+		// everything.
+		if strings.Contains(test.query, "field=") && f.rows >= len(f.docs) {
+			t.Errorf("%v: fetched %v rows", test.query, f.rows)
+		}
+	}
+
+	views, _ := f.design["views"].(map[string]interface{})
+	if views["by_ts"] == nil || views["by_field_ts"] == nil {
+		t.Fatalf("Design doc wasn't created: %v", f.design)
+	}
+
+	for _, q := range []string{"?page=0", "?page=-1", "?page=x"} {
+		if r, err := GetStoreReader(srv.URL + "/stats" + q); err == nil {
+			r.Close()
+			t.Errorf("Expected an error opening %v", q)
+		}
+	}
+}
+
+func TestCouchReaderOldDesign(t *testing.T) {
+	f := newFakeCouch(t, 4)
+	// What older versions created.
+	f.design = map[string]interface{}{
+		"_rev":     "1-x",
+		"language": "javascript",
+		"views": map[string]interface{}{
+			"by_ts": map[string]interface{}{"map": couchTSMap},
+		},
+	}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	r, err := GetStoreReader(srv.URL + "/stats?field=name&value=run1")
+	if err != nil {
+		t.Fatalf("Error opening reader: %v", err)
+	}
+	r.Close()
+	views, _ := f.design["views"].(map[string]interface{})
+	if views["by_ts"] == nil || views["by_field_ts"] == nil {
+		t.Fatalf("Design doc wasn't updated: %v", f.design)
+	}
+}
+
+func TestCouchReaderReadOnly(t *testing.T) {
+	f := newFakeCouch(t, 4)
+	f.readOnly = true
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	_, err := GetStoreReader(srv.URL + "/stats")
+	if err == nil || !strings.Contains(err.Error(), "view=") {
+		t.Fatalf("Expected advice on the missing views, got %v", err)
+	}
+
+	// Nothing to add, so nothing to refuse.
+	f.design = map[string]interface{}{"_rev": "1-x", "views": couchViews}
+	r, err := GetStoreReader(srv.URL + "/stats")
+	if err != nil {
+		t.Fatalf("Error opening reader: %v", err)
+	}
+	defer r.Close()
+	if _, err := r.Next(); err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+}
+
+func (f *fakeCouch) bulkDocs(w http.ResponseWriter, req *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests++
+	if f.bulk == nil {
+		f.bulk = map[string]map[string]interface{}{}
+	}
+
+	in := struct {
+		Docs []map[string]interface{}
+	}{}
+	json.NewDecoder(req.Body).Decode(&in)
+
+	res := []BulkResult{}
+	for _, d := range in.Docs {
+		id := d["_id"].(string)
+		switch {
+		case d["fail"] != nil:
+			res = append(res, BulkResult{ID: id, Error: "forbidden",
+				Reason: "no"})
+		case f.bulk[id] != nil:
+			res = append(res, BulkResult{ID: id, Error: "conflict",
+				Reason: "Document update conflict."})
+		default:
+			f.bulk[id] = d
+			res = append(res, BulkResult{ID: id, Rev: "1-x"})
+		}
+	}
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(res)
+}
+
+func (f *fakeCouch) stored() (int, int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.bulk), f.requests
+}
+
+func TestCouchBatching(t *testing.T) {
+	f := &fakeCouch{t: t}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	items := []StoredItem{}
+	for i := 0; i < 7; i++ {
+		items = append(items, NewItem(map[string]interface{}{"i": i},
+			basetime.Add(time.Duration(i)*time.Second)))
+	}
+
+	// Store everything twice; the second pass shouldn't duplicate.
+	for pass := 0; pass < 2; pass++ {
+		fs, err := GetStorer(srv.URL + "/stats?batch=3&source=here")
+		if err != nil {
+			t.Fatalf("Error opening storer: %v", err)
+		}
+		for _, it := range items {
+			if _, _, err := fs.Insert(it); err != nil {
+				t.Fatalf("Error inserting: %v", err)
+			}
+		}
+		if n, _ := f.stored(); pass == 0 && n != 6 {
+			t.Fatalf("Expected two full batches before close, got %v", n)
+		}
+		if err := fs.Close(); err != nil {
+			t.Fatalf("Error closing: %v", err)
+		}
+	}
+
+	n, requests := f.stored()
+	if n != 7 || requests != 6 {
+		t.Fatalf("Expected 7 docs in 6 requests, got %v in %v", n, requests)
+	}
+	for id := range f.bulk {
+		if !strings.HasPrefix(id, "2012") || !strings.Contains(id, "-here-") {
+			t.Fatalf("Unexpected document id: %v", id)
+		}
+	}
+}
+
+func TestCouchBatchLatency(t *testing.T) {
+	f := &fakeCouch{t: t}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	fs, err := GetStorer(srv.URL + "/stats?batch=100&latency=10ms")
+	if err != nil {
+		t.Fatalf("Error opening storer: %v", err)
+	}
+	fs.Insert(NewItem(map[string]interface{}{"a": "ayyy"}, basetime))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for n, _ := f.stored(); n == 0; n, _ = f.stored() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Partial batch was never flushed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	fs.Insert(NewItem(map[string]interface{}{"fail": true}, basetime))
+	err = fs.Close()
+	if be, ok := err.(BulkError); !ok || len(be) != 1 ||
+		be[0].Error != "forbidden" {
+		t.Fatalf("Expected a per-document error, got %v", err)
+	}
+}
@@ -0,0 +1,293 @@
+package statstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const couchDesignDoc = "_design/statcap"
+const couchTSView = couchDesignDoc + "/_view/by_ts"
+const couchFieldView = couchDesignDoc + "/_view/by_field_ts"
+
+const defaultCouchPage = 500
+
+// Emits every document with a timestamp, keyed by it in epoch
+// milliseconds.  Stored timestamps carry their own zone and varying
+// precision, so they don't sort as strings.
+const couchTSMap = `function(doc) {
+  if (typeof doc.ts != "string") { return; }
+  var m = doc.ts.match(/^(.*T\d\d:\d\d:\d\d)(\.\d+)?(Z|[+-]\d\d:\d\d)$/);
+  if (!m) { return; }
+  var t = Date.parse(m[1] + (m[2] ? m[2].substr(0, 4) : "") + m[3]);
+  if (!isNaN(t)) { emit(t, null); }
+}`
+
+// The same, keyed by [field, value, time] for each top level string
+// or number (values as strings), so a run can be read without
+// fetching everything else.
+const couchFieldMap = `function(doc) {
+  if (typeof doc.ts != "string") { return; }
+  var m = doc.ts.match(/^(.*T\d\d:\d\d:\d\d)(\.\d+)?(Z|[+-]\d\d:\d\d)$/);
+  if (!m) { return; }
+  var t = Date.parse(m[1] + (m[2] ? m[2].substr(0, 4) : "") + m[3]);
+  if (isNaN(t)) { return; }
+  for (var k in doc) {
+    var v = doc[k];
+    if (k[0] != "_" && k != "ts" &&
+        (typeof v == "string" || typeof v == "number")) {
+      emit([k, String(v), t], null);
+    }
+  }
+}`
+
+var couchViews = map[string]interface{}{
+	"by_ts":       map[string]interface{}{"map": couchTSMap},
+	"by_field_ts": map[string]interface{}{"map": couchFieldMap},
+}
+
+// Reads documents back out of CouchDB in timestamp order.
+type couchReader struct {
+	db   *CouchDB
+	view string
+	page int
+
+	// Only return documents where field has this value.
+	field, value string
+	// Time range in epoch milliseconds, either end may be nil.
+	from, to interface{}
+
+	rows    []couchRow
+	nextKey interface{}
+	nextID  string
+	done    bool
+}
+
+type couchRow struct {
+	ID  string          `json:"id"`
+	Key interface{}     `json:"key"`
+	Doc json.RawMessage `json:"doc"`
+}
+
+// Make sure the views we page through exist, adding them to a design
+// doc made by an older version if need be.
+func (c *couchReader) ensureView() error {
+	if c.view != couchTSView && c.view != couchFieldView {
+		return nil
+	}
+	design := map[string]interface{}{}
+	err := c.db.do("GET", c.db.docURL(couchDesignDoc, nil), nil, &design)
+	switch {
+	case couchStatus(err) == http.StatusNotFound:
+		design = map[string]interface{}{"language": "javascript"}
+	case err != nil:
+		return err
+	}
+	views, _ := design["views"].(map[string]interface{})
+	if views == nil {
+		views = map[string]interface{}{}
+	}
+	missing := false
+	for name, v := range couchViews {
+		if _, ok := views[name]; !ok {
+			views[name] = v
+			missing = true
+		}
+	}
+	if !missing {
+		return nil
+	}
+	design["views"] = views
+	err = c.db.do("PUT", c.db.docURL(couchDesignDoc, nil), design, nil)
+	if err != nil {
+		return fmt.Errorf("can't add the %v views (%v); pass view= to read "+
+			"with an existing view, or have an admin run this once", couchDesignDoc, err)
+	}
+	return nil
+}
+
+// The view key for a time, taking the field into account.
+func (c *couchReader) key(t interface{}) interface{} {
+	if c.view != couchFieldView {
+		return t
+	}
+	return []interface{}{c.field, c.value, t}
+}
+
+func (c *couchReader) fetch() error {
+	params := map[string]interface{}{
+		"include_docs": true,
+		"limit":        c.page + 1,
+	}
+	switch {
+	case c.nextKey != nil:
+		params["startkey"] = c.nextKey
+		params["startkey_docid"] = c.nextID
+	case c.from != nil:
+		params["startkey"] = c.key(c.from)
+	case c.view == couchFieldView:
+		params["startkey"] = []interface{}{c.field, c.value}
+	}
+	switch {
+	case c.to != nil:
+		params["endkey"] = c.key(c.to)
+		params["inclusive_end"] = false
+	case c.view == couchFieldView:
+		// Objects sort after numbers.
+		params["endkey"] = []interface{}{c.field, c.value,
+			map[string]interface{}{}}
+	}
+
+	res := struct {
+		Rows []couchRow `json:"rows"`
+	}{}
+	if err := c.db.Query(c.view, params, &res); err != nil {
+		return err
+	}
+
+	c.rows = res.Rows
+	if len(c.rows) > c.page {
+		last := c.rows[c.page]
+		c.nextKey, c.nextID = last.Key, last.ID
+		c.rows = c.rows[:c.page]
+	} else {
+		c.done = true
+	}
+	return nil
+}
+
+// Turn a stored document back into an item, dropping the CouchDB
+// bookkeeping fields so it can be stored somewhere else.
+func couchItem(doc json.RawMessage) (StoredItem, error) {
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(doc, &m); err != nil {
+		return StoredItem{}, err
+	}
+	delete(m, "_id")
+	delete(m, "_rev")
+	b, err := json.Marshal(m)
+	if err != nil {
+		return StoredItem{}, err
+	}
+	rm := json.RawMessage(b)
+	return StoredItem{rawJ: &rm}, nil
+}
+
+// Whether a document has the field value asked for.  Only needed for
+// someone else's view; ours is keyed by it.
+func (c *couchReader) matches(doc json.RawMessage) bool {
+	if c.field == "" || c.view == couchFieldView {
+		return true
+	}
+	m := map[string]interface{}{}
+	if json.Unmarshal(doc, &m) != nil {
+		return false
+	}
+	switch v := m[c.field].(type) {
+	case string:
+		return v == c.value
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64) == c.value
+	}
+	return false
+}
+
+func (c *couchReader) Next() (StoredItem, error) {
+	for {
+		for len(c.rows) > 0 {
+			row := c.rows[0]
+			c.rows = c.rows[1:]
+			if !c.matches(row.Doc) {
+				continue
+			}
+			return couchItem(row.Doc)
+		}
+		if c.done {
+			return StoredItem{}, io.EOF
+		}
+		if err := c.fetch(); err != nil {
+			return StoredItem{}, err
+		}
+	}
+}
+
+// Documents in a database don't have a header.
+func (c *couchReader) Header() (*Header, error) {
+	return nil, nil
+}
+
+func (c *couchReader) Close() error {
+	return nil
+}
+
+// Convert a time range bound to a view key.
+func couchTime(s string) (interface{}, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil, err
+	}
+	return t.UnixNano() / int64(time.Millisecond), nil
+}
+
+// Open a reader for a CouchDB URL.  Query parameters:
+//
+//	field, value  only return documents with field == value
+//	              (e.g. field=name&value=run42)
+//	from, to      RFC3339 time range (from inclusive, to exclusive)
+//	page          documents fetched per request
+//	view          a view keyed by ts to use instead of our own (field
+//	              is then checked as documents are read)
+func openCouchReader(path string) (*couchReader, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+
+	rv := &couchReader{
+		view:  couchTSView,
+		page:  defaultCouchPage,
+		field: q.Get("field"),
+		value: q.Get("value"),
+	}
+	if v := q.Get("view"); v != "" {
+		rv.view = v
+	} else if rv.field != "" {
+		rv.view = couchFieldView
+	}
+	if p := q.Get("page"); p != "" {
+		rv.page, err = strconv.Atoi(p)
+		if err != nil {
+			return nil, err
+		}
+		if rv.page < 1 {
+			return nil, fmt.Errorf("invalid page: %v", p)
+		}
+	}
+	if rv.from, err = couchTime(q.Get("from")); err != nil {
+		return nil, err
+	}
+	if rv.to, err = couchTime(q.Get("to")); err != nil {
+		return nil, err
+	}
+	for _, k := range []string{"field", "value", "view", "page", "from", "to"} {
+		q.Del(k)
+	}
+	u.RawQuery = q.Encode()
+
+	rv.db, err = OpenCouchDB(u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := rv.ensureView(); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
@@ -1,25 +1,202 @@
 package statstore
 
 import (
-	"code.google.com/p/dsallings-couch-go"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
 )
 
+// The format of the timestamp at the front of generated document IDs,
+// which sorts chronologically.
+const couchIDTimeFormat = "20060102T150405.000000000Z"
+
+// How a couch storer batches inserts.
+type BatchOptions struct {
+	// Documents per _bulk_docs request.  Anything less than two
+	// stores each document as it's inserted.
+	Size int
+	// The longest a document waits in a partial batch.
+	Latency time.Duration
+	// Identifies where documents came from, as part of their IDs.
+	Source string
+}
+
 type couchStorer struct {
-	db couch.Database
+	db   *CouchDB
+	opts BatchOptions
+
+	lock    sync.Mutex
+	pending []interface{}
+	timer   *time.Timer
+	err     error
+	flushes sync.WaitGroup
 }
 
-func (cc *couchStorer) Close() error {
-	return nil
+// A document ID derived from the document's timestamp, its source,
+// and its content, so storing the same document again (e.g. when a
+// batch is retried) can't create a duplicate.
+func couchDocID(ts time.Time, source string, body []byte) string {
+	h := sha1.Sum(body)
+	id := ts.UTC().Format(couchIDTimeFormat)
+	if source != "" {
+		id += "-" + source
+	}
+	return id + "-" + hex.EncodeToString(h[:8])
+}
+
+// Serialize an item with a deterministic _id (unless it already has
+// one).
+func couchDoc(m StoredItem, source string) (string, json.RawMessage, error) {
+	b, err := m.MarshalJSON()
+	if err != nil {
+		return "", nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return "", nil, err
+	}
+	var id string
+	if raw, ok := fields["_id"]; ok {
+		err = json.Unmarshal(raw, &id)
+		return id, b, err
+	}
+	ts, err := m.TimestampE()
+	if err != nil {
+		return "", nil, err
+	}
+	if _, ok := fields["ts"]; !ok {
+		raw, err := json.Marshal(ts)
+		if err != nil {
+			return "", nil, err
+		}
+		fields["ts"] = raw
+	}
+	id = couchDocID(ts, source, b)
+	fields["_id"], _ = json.Marshal(id)
+	b, err = json.Marshal(fields)
+	return id, b, err
+}
+
+// Send a batch, logging and remembering any failures.
+func (cc *couchStorer) send(docs []interface{}) ([]BulkResult, error) {
+	res, err := cc.db.BulkInsert(docs)
+	if err != nil {
+		log.Printf("Error storing %d documents: %v", len(docs), err)
+		cc.lock.Lock()
+		cc.err = err
+		cc.lock.Unlock()
+	}
+	return res, err
+}
+
+// Take the pending batch.  Must be called with the lock held.
+func (cc *couchStorer) take() []interface{} {
+	docs := cc.pending
+	cc.pending = nil
+	if cc.timer != nil {
+		// If the timer already fired, its flush accounts for
+		// itself.
+		if cc.timer.Stop() {
+			cc.flushes.Done()
+		}
+		cc.timer = nil
+	}
+	return docs
+}
+
+func (cc *couchStorer) flushLate() {
+	cc.lock.Lock()
+	docs := cc.take()
+	cc.lock.Unlock()
+	if len(docs) > 0 {
+		cc.send(docs)
+	}
+	cc.flushes.Done()
 }
 
 func (cc *couchStorer) Insert(m StoredItem) (string, string, error) {
-	return cc.db.Insert(m)
+	id, doc, err := couchDoc(m, cc.opts.Source)
+	if err != nil {
+		return "", "", err
+	}
+
+	cc.lock.Lock()
+	cc.pending = append(cc.pending, doc)
+	if len(cc.pending) < cc.opts.Size {
+		if cc.timer == nil && cc.opts.Latency > 0 {
+			cc.flushes.Add(1)
+			cc.timer = time.AfterFunc(cc.opts.Latency, cc.flushLate)
+		}
+		cc.lock.Unlock()
+		return id, "", nil
+	}
+	docs := cc.take()
+	cc.lock.Unlock()
+
+	res, err := cc.send(docs)
+	for _, r := range res {
+		if r.ID == id {
+			return id, r.Rev, err
+		}
+	}
+	return id, "", err
 }
 
+// Flush anything pending, returning the last error seen by any
+// batch.
+func (cc *couchStorer) Close() error {
+	cc.lock.Lock()
+	docs := cc.take()
+	cc.lock.Unlock()
+
+	if len(docs) > 0 {
+		cc.send(docs)
+	}
+	cc.flushes.Wait()
+
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	return cc.err
+}
+
+// Make a storer that writes to a CouchDB database, batching inserts
+// into _bulk_docs requests.
+func NewCouchStorer(db *CouchDB, opts BatchOptions) Storer {
+	return &couchStorer{db: db, opts: opts}
+}
+
+// Open a couch storer.  Batching is configured by the query
+// parameters batch (size), latency (e.g. 5s) and source.
 func openCouchStorer(path string) (Storer, error) {
-	f, err := couch.Connect(path)
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	opts := BatchOptions{Source: q.Get("source")}
+	if b := q.Get("batch"); b != "" {
+		if opts.Size, err = strconv.Atoi(b); err != nil {
+			return nil, err
+		}
+	}
+	if l := q.Get("latency"); l != "" {
+		if opts.Latency, err = time.ParseDuration(l); err != nil {
+			return nil, err
+		}
+	}
+	for _, k := range []string{"batch", "latency", "source"} {
+		q.Del(k)
+	}
+	u.RawQuery = q.Encode()
+
+	db, err := OpenCouchDB(u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
-	return &couchStorer{f}, nil
+	return NewCouchStorer(db, opts), nil
 }
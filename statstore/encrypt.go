@@ -0,0 +1,422 @@
+package statstore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encrypted captures start with this, followed by the file key
+// wrapped for each recipient:
+//
+//	magic
+//	uint16 number of recipients
+//	per recipient: 32 byte ephemeral X25519 key, 48 byte wrapped key
+//
+// and then the payload in chunks, each sealed with AES-GCM under a
+// key derived from the file key and a hash of the header:
+//
+//	1 byte flag (1 on the last chunk), uint32 length, ciphertext
+//
+// A chunk's nonce is its sequence number and flag, so chunks can't be
+// reordered, and a file cut off at a chunk boundary is still seen to
+// be incomplete.  Another header may follow the last chunk (as when
+// appending), and is read as a continuation.
+const encMagic = "statcap-encrypted-v1\n"
+
+const (
+	encChunkSize = 64 << 10
+	encKeySize   = 32
+	encStanzaLen = 32 + encKeySize + 16
+
+	encRecipientPrefix = "statcap-public:"
+	encIdentityPrefix  = "statcap-secret:"
+)
+
+var ErrNoIdentity = errors.New("no identity can decrypt this capture")
+
+var errEncCorrupt = errors.New("encrypted capture is corrupt or was tampered with")
+
+// Who a capture is encrypted for.
+type Recipient struct {
+	key *ecdh.PublicKey
+}
+
+// What decrypts captures encrypted for its Recipient.
+type Identity struct {
+	key *ecdh.PrivateKey
+}
+
+// Make a new identity.
+func GenerateIdentity() (*Identity, error) {
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{k}, nil
+}
+
+// The recipient to encrypt captures for this identity with.
+func (i *Identity) Recipient() *Recipient {
+	return &Recipient{i.key.PublicKey()}
+}
+
+func (i *Identity) String() string {
+	return encIdentityPrefix + base64.RawStdEncoding.EncodeToString(i.key.Bytes())
+}
+
+func (r *Recipient) String() string {
+	return encRecipientPrefix + base64.RawStdEncoding.EncodeToString(r.key.Bytes())
+}
+
+func decodeKey(s, prefix string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, prefix) {
+		return nil, fmt.Errorf("not a %v key", strings.TrimSuffix(prefix, ":"))
+	}
+	return base64.RawStdEncoding.DecodeString(s[len(prefix):])
+}
+
+// Parse a recipient as written by Recipient.String.
+func ParseRecipient(s string) (*Recipient, error) {
+	b, err := decodeKey(s, encRecipientPrefix)
+	if err != nil {
+		return nil, err
+	}
+	k, err := ecdh.X25519().NewPublicKey(b)
+	if err != nil {
+		return nil, err
+	}
+	return &Recipient{k}, nil
+}
+
+// Parse an identity as written by Identity.String.
+func ParseIdentity(s string) (*Identity, error) {
+	b, err := decodeKey(s, encIdentityPrefix)
+	if err != nil {
+		return nil, err
+	}
+	k, err := ecdh.X25519().NewPrivateKey(b)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{k}, nil
+}
+
+// The non-blank, non-comment lines of a key file.
+func keyLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rv := []string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l != "" && !strings.HasPrefix(l, "#") {
+			rv = append(rv, l)
+		}
+	}
+	return rv, s.Err()
+}
+
+// Read recipients from a file, one per line.  Blank lines and lines
+// starting with # are ignored.
+func LoadRecipients(path string) ([]*Recipient, error) {
+	lines, err := keyLines(path)
+	if err != nil {
+		return nil, err
+	}
+	rv := []*Recipient{}
+	for _, l := range lines {
+		r, err := ParseRecipient(l)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+		rv = append(rv, r)
+	}
+	return rv, nil
+}
+
+// Read identities from a file, one per line.
+func LoadIdentities(path string) ([]*Identity, error) {
+	lines, err := keyLines(path)
+	if err != nil {
+		return nil, err
+	}
+	rv := []*Identity{}
+	for _, l := range lines {
+		i, err := ParseIdentity(l)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+		rv = append(rv, i)
+	}
+	return rv, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// The key that wraps the file key for one recipient.
+func wrapKey(shared, ephemeral, recipient []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	k, err := hkdf.Key(sha256.New, shared, salt, encMagic+"wrap", encKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(k)
+}
+
+// The key the payload is sealed with, bound to the whole header.
+func payloadKey(fileKey, header []byte) (cipher.AEAD, error) {
+	h := sha256.Sum256(header)
+	k, err := hkdf.Key(sha256.New, fileKey, h[:], encMagic+"payload", encKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(k)
+}
+
+func chunkNonce(seq uint64, last bool) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[3:11], seq)
+	if last {
+		n[11] = 1
+	}
+	return n
+}
+
+// Encrypts a stream for a set of recipients.  Data is sealed a chunk
+// at a time as it's written (or flushed), so nothing but the current
+// chunk is held in memory.
+type EncryptWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	buf  []byte
+	seq  uint64
+}
+
+// Start an encrypted stream on w.  Close finishes the stream, but
+// doesn't close w.
+func NewEncryptWriter(w io.Writer, recipients []*Recipient) (*EncryptWriter, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients to encrypt for")
+	}
+	fileKey := make([]byte, encKeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, err
+	}
+
+	header := []byte(encMagic)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(recipients)))
+	for _, r := range recipients {
+		eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := eph.ECDH(r.key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := wrapKey(shared, eph.PublicKey().Bytes(), r.key.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, eph.PublicKey().Bytes()...)
+		// Each wrapping key is used once, so a zero nonce is fine.
+		header = aead.Seal(header, make([]byte, aead.NonceSize()), fileKey, nil)
+	}
+
+	aead, err := payloadKey(fileKey, header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &EncryptWriter{w: w, aead: aead,
+		buf: make([]byte, 0, encChunkSize)}, nil
+}
+
+func (e *EncryptWriter) writeChunk(last bool) error {
+	out := make([]byte, 5, 5+len(e.buf)+e.aead.Overhead())
+	if last {
+		out[0] = 1
+	}
+	out = e.aead.Seal(out, chunkNonce(e.seq, last), e.buf, nil)
+	binary.BigEndian.PutUint32(out[1:5], uint32(len(out)-5))
+	e.seq++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(out)
+	return err
+}
+
+func (e *EncryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		c := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+		n += c
+		if len(e.buf) == cap(e.buf) {
+			if err := e.writeChunk(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Seal whatever's been written so far into a (short) chunk.
+func (e *EncryptWriter) Flush() error {
+	if len(e.buf) == 0 {
+		return nil
+	}
+	return e.writeChunk(false)
+}
+
+// Write the last chunk.
+func (e *EncryptWriter) Close() error {
+	return e.writeChunk(true)
+}
+
+type decryptReader struct {
+	r          *bufio.Reader
+	identities []*Identity
+
+	aead cipher.AEAD
+	seq  uint64
+	// The current chunk's plaintext not yet read.
+	buf  []byte
+	last bool
+}
+
+// Read an encrypted stream with whichever of the identities it was
+// encrypted for.  A stream that ends early reads as
+// io.ErrUnexpectedEOF.
+func NewDecryptReader(r io.Reader, identities []*Identity) (io.Reader, error) {
+	d := &decryptReader{r: bufio.NewReader(r), identities: identities}
+	if err := d.readHeader(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (d *decryptReader) readHeader() error {
+	header := make([]byte, len(encMagic)+2)
+	if _, err := io.ReadFull(d.r, header); err != nil {
+		return unexpected(err)
+	}
+	if string(header[:len(encMagic)]) != encMagic {
+		return fmt.Errorf("not an encrypted capture")
+	}
+	n := int(binary.BigEndian.Uint16(header[len(encMagic):]))
+	stanzas := make([]byte, n*encStanzaLen)
+	if _, err := io.ReadFull(d.r, stanzas); err != nil {
+		return unexpected(err)
+	}
+	header = append(header, stanzas...)
+
+	for ; len(stanzas) > 0; stanzas = stanzas[encStanzaLen:] {
+		ephBytes, wrapped := stanzas[:32], stanzas[32:encStanzaLen]
+		eph, err := ecdh.X25519().NewPublicKey(ephBytes)
+		if err != nil {
+			return errEncCorrupt
+		}
+		for _, id := range d.identities {
+			shared, err := id.key.ECDH(eph)
+			if err != nil {
+				continue
+			}
+			aead, err := wrapKey(shared, ephBytes, id.key.PublicKey().Bytes())
+			if err != nil {
+				return err
+			}
+			fileKey, err := aead.Open(nil, make([]byte, aead.NonceSize()),
+				wrapped, nil)
+			if err != nil {
+				continue
+			}
+			d.aead, err = payloadKey(fileKey, header)
+			d.seq, d.last = 0, false
+			return err
+		}
+	}
+	return ErrNoIdentity
+}
+
+func (d *decryptReader) readChunk() error {
+	if d.last {
+		// Either the end, or another stream appended after this one.
+		if _, err := d.r.Peek(1); err != nil {
+			return err
+		}
+		if err := d.readHeader(); err != nil {
+			return err
+		}
+	}
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(d.r, head); err != nil {
+		return unexpected(err)
+	}
+	last := head[0] == 1
+	n := binary.BigEndian.Uint32(head[1:])
+	if head[0] > 1 || n > encChunkSize+uint32(d.aead.Overhead()) {
+		return errEncCorrupt
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return unexpected(err)
+	}
+	plain, err := d.aead.Open(sealed[:0], chunkNonce(d.seq, last), sealed, nil)
+	if err != nil {
+		return errEncCorrupt
+	}
+	d.seq++
+	d.buf, d.last = plain, last
+	return nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if err := d.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// Whether a file starts like an encrypted capture.
+func isEncrypted(f *os.File) bool {
+	b := make([]byte, len(encMagic))
+	n, _ := f.ReadAt(b, 0)
+	return bytes.Equal(b[:n], []byte(encMagic))
+}
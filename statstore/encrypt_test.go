@@ -0,0 +1,247 @@
+package statstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+// Write an identity file, and a recipients file for it.
+func writeKeys(t *testing.T, name string) (string, string) {
+	id, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Error generating identity: %v", err)
+	}
+	idFile, pubFile := name+".key", name+".pub"
+	err = os.WriteFile(idFile, []byte("# me\n"+id.String()+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("Error writing identity: %v", err)
+	}
+	err = os.WriteFile(pubFile, []byte(id.Recipient().String()+"\n"), 0644)
+	if err != nil {
+		t.Fatalf("Error writing recipient: %v", err)
+	}
+	return idFile, pubFile
+}
+
+func TestEncryptStream(t *testing.T) {
+	ids := []*Identity{}
+	rcpts := []*Recipient{}
+	for i := 0; i < 2; i++ {
+		id, err := GenerateIdentity()
+		if err != nil {
+			t.Fatalf("Error generating identity: %v", err)
+		}
+		ids = append(ids, id)
+		rcpts = append(rcpts, id.Recipient())
+	}
+
+	// Several chunks, with a short one flushed in the middle.
+	plain := make([]byte, 3*encChunkSize+100)
+	rand.Read(plain)
+	buf := &bytes.Buffer{}
+	w, err := NewEncryptWriter(buf, rcpts)
+	if err != nil {
+		t.Fatalf("Error starting encryption: %v", err)
+	}
+	w.Write(plain[:1000])
+	w.Flush()
+	w.Write(plain[1000:])
+	if err := w.Close(); err != nil {
+		t.Fatalf("Error finishing encryption: %v", err)
+	}
+	enc := buf.Bytes()
+	if bytes.Contains(enc, plain[:100]) {
+		t.Fatalf("Plaintext found in encrypted stream")
+	}
+
+	// Either recipient can read it.
+	for _, id := range ids {
+		r, err := NewDecryptReader(bytes.NewReader(enc), []*Identity{id})
+		if err != nil {
+			t.Fatalf("Error starting decryption: %v", err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Error decrypting: %v", err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("Didn't round trip")
+		}
+	}
+
+	other, _ := GenerateIdentity()
+	_, err = NewDecryptReader(bytes.NewReader(enc), []*Identity{other})
+	if err != ErrNoIdentity {
+		t.Fatalf("Expected ErrNoIdentity, got %v", err)
+	}
+
+	tampered := append([]byte{}, enc...)
+	tampered[len(tampered)-20] ^= 1
+	r, _ := NewDecryptReader(bytes.NewReader(tampered), ids)
+	if _, err := io.ReadAll(r); err != errEncCorrupt {
+		t.Fatalf("Expected tampering to be caught, got %v", err)
+	}
+
+	// Cut off after a whole chunk, which must still be noticed.
+	cut := len(enc) - (5 + 100 + 16)
+	r, _ = NewDecryptReader(bytes.NewReader(enc[:cut]), ids)
+	if _, err := io.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected truncation to be caught, got %v", err)
+	}
+}
+
+func TestEncryptedCapture(t *testing.T) {
+	filename := "testencrypted.gz"
+	idFile, pubFile := writeKeys(t, "testencrypted")
+	defer os.Remove(filename)
+	defer os.Remove(idFile)
+	defer os.Remove(pubFile)
+
+	for i, n := range []int{3, 2} {
+		u := "file:" + filename + "?recipients=" + pubFile
+		if i > 0 {
+			u += "&mode=append"
+		}
+		fs, err := GetStorer(u)
+		if err != nil {
+			t.Fatalf("Error opening %v: %v", u, err)
+		}
+		for j := 0; j < n; j++ {
+			k := i*3 + j
+			_, _, err := fs.Insert(NewItem(map[string]interface{}{"i": k,
+				"host": "secret.example.com"}, itemTime(k)))
+			if err != nil {
+				t.Fatalf("Error storing item: %v", err)
+			}
+		}
+		if err := fs.Close(); err != nil {
+			t.Fatalf("Error closing: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Error reading %v: %v", filename, err)
+	}
+	if !bytes.HasPrefix(data, []byte(encMagic)) {
+		t.Fatalf("Capture isn't encrypted")
+	}
+
+	if _, err := GetStoreReader(filename); err == nil {
+		t.Fatalf("Expected an error reading without an identity")
+	}
+
+	r, err := GetStoreReader("file:" + filename + "?identity=" + idFile)
+	if err != nil {
+		t.Fatalf("Error opening reader: %v", err)
+	}
+	defer r.Close()
+	sr := r.(SeekableReader)
+	if n, err := sr.Len(); err != nil || n != 5 {
+		t.Fatalf("Expected 5 items, got %v/%v", n, err)
+	}
+	for i := 0; i < 5; i++ {
+		expectNext(t, r, i)
+	}
+	expectNext(t, r, -1)
+	sr.Seek(itemTime(3))
+	expectNext(t, sr, 3)
+
+	// The identity can come from the environment, too.
+	os.Setenv(identityEnv, idFile)
+	defer os.Unsetenv(identityEnv)
+	if got := readItems(t, filename); len(got) != 5 {
+		t.Fatalf("Expected 5 items, got %v", got)
+	}
+
+	// A truncated encrypted capture is reported like any other.
+	if err := os.WriteFile(filename, data[:len(data)-30], 0666); err != nil {
+		t.Fatalf("Error truncating: %v", err)
+	}
+	r2, err := GetStoreReader(filename)
+	if err != nil {
+		t.Fatalf("Error opening truncated capture: %v", err)
+	}
+	defer r2.Close()
+	for {
+		_, err := r2.Next()
+		if errors.Is(err, ErrTruncated) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Expected truncation, got %v", err)
+		}
+	}
+}
+
+func TestAppendEncryptionMismatch(t *testing.T) {
+	enc, plain := "testappendenc.gz", "testappendplain.gz"
+	idFile, pubFile := writeKeys(t, "testappendenc")
+	defer os.Remove(enc)
+	defer os.Remove(plain)
+	defer os.Remove(idFile)
+	defer os.Remove(pubFile)
+
+	writeItems(t, "file:"+enc+"?recipients="+pubFile, 0)
+	writeItems(t, plain, 0)
+	encData, _ := os.ReadFile(enc)
+	plainData, _ := os.ReadFile(plain)
+
+	for _, u := range []string{
+		"file:" + enc + "?mode=append",
+		"file:" + plain + "?mode=append&recipients=" + pubFile,
+	} {
+		if fs, err := GetStorer(u); err == nil {
+			fs.Close()
+			t.Errorf("Expected an error opening %v", u)
+		}
+	}
+
+	// Neither was touched.
+	if got, _ := os.ReadFile(enc); !bytes.Equal(got, encData) {
+		t.Errorf("%v was changed", enc)
+	}
+	if got, _ := os.ReadFile(plain); !bytes.Equal(got, plainData) {
+		t.Errorf("%v was changed", plain)
+	}
+}
+
+func TestAppendEncryptedAfterCrash(t *testing.T) {
+	filename := "testappendenccrash.gz"
+	idFile, pubFile := writeKeys(t, "testappendenccrash")
+	defer os.Remove(filename)
+	defer os.Remove(idFile)
+	defer os.Remove(pubFile)
+
+	writeCrashed(t, "file:"+filename+"?flushrecords=3&recipients="+pubFile,
+		filename)
+	data, _ := os.ReadFile(filename)
+
+	fs, err := GetStorer("file:" + filename + "?mode=append&recipients=" + pubFile)
+	if err == nil {
+		fs.Close()
+		t.Fatalf("Expected an error appending to an unfinished capture")
+	}
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("Expected a truncation error, got %v", err)
+	}
+	if got, _ := os.ReadFile(filename); !bytes.Equal(got, data) {
+		t.Errorf("%v was changed", filename)
+	}
+
+	// A finished one can be appended to.
+	writeItems(t, "file:"+filename+"?recipients="+pubFile+"&mode=overwrite", 0)
+	writeItems(t, "file:"+filename+"?recipients="+pubFile+"&mode=append", 1)
+	r, err := GetStoreReader("file:" + filename + "?identity=" + idFile)
+	if err != nil {
+		t.Fatalf("Error opening %v: %v", filename, err)
+	}
+	defer r.Close()
+	expectNext(t, r, 0)
+	expectNext(t, r, 1)
+	expectNext(t, r, -1)
+}
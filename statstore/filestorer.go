@@ -1,57 +1,349 @@
 package statstore
 
 import (
+	"bufio"
 	"compress/gzip"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+// Returned (wrapped) by a gzip capture reader after the last complete
+// record of a file that ends part way through, e.g. one still being
+// written or left behind by a crash.
+var ErrTruncated = errors.New("capture is truncated")
+
+// When a gzip capture pushes what it's compressed so far out to the
+// file.  Until then, records are only in memory.
+type flushOptions struct {
+	// Flush this long after the first unflushed record.
+	every time.Duration
+	// Flush after this many records.
+	records int
+	// fsync after every flush (and on close).
+	fsync bool
+}
+
+var defaultFlush = flushOptions{every: 10 * time.Second}
+
+// How a gzip capture is written.
+type fileOptions struct {
+	flush flushOptions
+	// Encrypt the capture for these, if any.
+	recipients []*Recipient
+}
+
+var defaultFileOptions = fileOptions{flush: defaultFlush}
+
+// Where the identity to decrypt captures with is found when a URL
+// doesn't say.
+const identityEnv = "STATCAP_IDENTITY"
+
 type fileStorer struct {
 	lock sync.Mutex
 	file *os.File
 	z    *gzip.Writer
-	e    *json.Encoder
+	// Sits between the compressor and the file of encrypted
+	// captures.
+	enc *EncryptWriter
+
+	// Whether the file was empty when it was opened, and so should
+	// start with a header.
+	fresh bool
+
+	flush     flushOptions
+	unflushed int
+	timer     *time.Timer
+	closed    bool
+	// An error from a timed flush, reported by the next Insert.
+	err error
+
+	// Whether anything's been written since the last gzip member
+	// was finished, and whether one has been.
+	pending, finished bool
+}
+
+// Must be called with the lock held.
+func (ff *fileStorer) flushLocked() error {
+	if ff.timer != nil {
+		ff.timer.Stop()
+		ff.timer = nil
+	}
+	if ff.unflushed == 0 {
+		return nil
+	}
+	ff.unflushed = 0
+	// Each flush finishes a gzip member, so a reader can start
+	// decompressing from there.
+	if err := ff.z.Close(); err != nil {
+		return err
+	}
+	ff.z.Reset(ff.compressed())
+	ff.pending, ff.finished = false, true
+	if ff.enc != nil {
+		if err := ff.enc.Flush(); err != nil {
+			return err
+		}
+	}
+	if ff.flush.fsync {
+		return ff.file.Sync()
+	}
+	return nil
+}
+
+func (ff *fileStorer) flushLate() {
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+	if ff.closed {
+		return
+	}
+	ff.timer = nil
+	if err := ff.flushLocked(); err != nil {
+		log.Printf("Error flushing %v: %v", ff.file.Name(), err)
+		ff.err = err
+	}
 }
 
 func (ff *fileStorer) Insert(ob StoredItem) (string, string, error) {
 	ff.lock.Lock()
 	defer ff.lock.Unlock()
 
+	if err := ff.err; err != nil {
+		ff.err = nil
+		return "", "", err
+	}
+
 	// Add a timestamp if there isn't one.
-	m := (*ob.rawI).(map[string]interface{})
-	if _, ok := m["ts"]; !ok {
-		m["ts"] = ob.Timestamp()
+	b, err := ob.jsonWithTS()
+	if err != nil {
+		return "", "", err
 	}
+	if _, err := ff.z.Write(append(b, '\n')); err != nil {
+		return "", "", err
+	}
+	ff.unflushed++
+	ff.pending = true
 
-	return "", "", ff.e.Encode(m)
+	if ff.flush.records > 0 && ff.unflushed >= ff.flush.records {
+		return "", "", ff.flushLocked()
+	}
+	if ff.flush.every > 0 && ff.timer == nil {
+		ff.timer = time.AfterFunc(ff.flush.every, ff.flushLate)
+	}
+	return "", "", nil
+}
+
+func (ff *fileStorer) writeHeader(h Header) error {
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+
+	if !ff.fresh {
+		return nil
+	}
+	b, err := headerRecord(h)
+	if err != nil {
+		return err
+	}
+	ff.pending = true
+	_, err = ff.z.Write(b)
+	return err
+}
+
+// Where compressed data goes.
+func (ff *fileStorer) compressed() io.Writer {
+	if ff.enc != nil {
+		return ff.enc
+	}
+	return ff.file
+}
+
+func (ff *fileStorer) size() (int64, error) {
+	st, err := ff.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
 }
 
 func (ff *fileStorer) Close() error {
 	ff.lock.Lock()
 	defer ff.lock.Unlock()
 	defer ff.file.Close()
-	return ff.z.Close()
+
+	ff.closed = true
+	if ff.timer != nil {
+		ff.timer.Stop()
+		ff.timer = nil
+	}
+	// An empty capture is still a gzip file, but there's no need
+	// for an empty member after the last flush.
+	if ff.pending || !ff.finished {
+		if err := ff.z.Close(); err != nil {
+			return err
+		}
+	}
+	if ff.enc != nil {
+		if err := ff.enc.Close(); err != nil {
+			return err
+		}
+	}
+	if ff.flush.fsync {
+		return ff.file.Sync()
+	}
+	return nil
+}
+
+// Read options from the query parameters of a file: URL: flush (an
+// interval such as 30s, or 0 to only flush on close), flushrecords,
+// fsync=true and recipients (a file of keys to encrypt for, which
+// may be given more than once).
+func fileOptionsFromURL(u *url.URL) (fileOptions, error) {
+	q := u.Query()
+	rv := defaultFileOptions
+	var err error
+	if s := q.Get("flush"); s != "" {
+		if s == "0" {
+			rv.flush.every = 0
+		} else if rv.flush.every, err = time.ParseDuration(s); err != nil {
+			return rv, err
+		}
+	}
+	if s := q.Get("flushrecords"); s != "" {
+		if rv.flush.records, err = strconv.Atoi(s); err != nil {
+			return rv, err
+		}
+	}
+	if s := q.Get("fsync"); s != "" {
+		if rv.flush.fsync, err = strconv.ParseBool(s); err != nil {
+			return rv, err
+		}
+	}
+	for _, path := range q["recipients"] {
+		r, err := LoadRecipients(path)
+		if err != nil {
+			return rv, err
+		}
+		rv.recipients = append(rv.recipients, r...)
+	}
+	return rv, nil
+}
+
+// The identities named by identity query parameters of a file: URL.
+func identitiesFromURL(u *url.URL) ([]*Identity, error) {
+	rv := []*Identity{}
+	for _, path := range u.Query()["identity"] {
+		ids, err := LoadIdentities(path)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, ids...)
+	}
+	return rv, nil
 }
 
-func openFileStorer(filepath string) (*fileStorer, error) {
-	f, err := os.Create(filepath)
+// Appending plain records to an encrypted capture (or the other way
+// around) would leave it unreadable past the join, and so would
+// appending to one that was never finished (e.g. statcap was killed),
+// so an unfinished gzip capture is repaired first.
+func checkAppendable(filepath string, opts fileOptions) error {
+	f, err := os.Open(filepath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil || st.Size() == 0 {
+		return err
+	}
+	switch enc := isEncrypted(f); {
+	case enc && len(opts.recipients) == 0:
+		return fmt.Errorf("%v is encrypted; append to it with recipients", filepath)
+	case !enc && len(opts.recipients) > 0:
+		return fmt.Errorf("%v isn't encrypted; can't append encrypted records", filepath)
+	case enc:
+		if err := checkEncryptedEnd(f); err != nil {
+			return fmt.Errorf("can't append to %v: %w (it can still be read "+
+				"with its identity, but start a new capture)", filepath, err)
+		}
+		return nil
+	}
+	return repairGzipTail(filepath)
+}
+
+// Open a gzip capture.  Appending starts a new gzip member at the
+// end of the file, which gzip readers treat as a continuation (and
+// for encrypted captures, a new encrypted stream).
+func openFileStorer(filepath string, mode Mode,
+	opts fileOptions) (*fileStorer, error) {
+
+	if mode == Append {
+		if err := checkAppendable(filepath, opts); err != nil {
+			return nil, err
+		}
+	}
+	f, err := openForMode(filepath, mode)
 	if err != nil {
 		return nil, err
 	}
-	z := gzip.NewWriter(f)
-	e := json.NewEncoder(z)
-	return &fileStorer{
-		file: f,
-		z:    z,
-		e:    e,
-	}, nil
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	rv := &fileStorer{
+		file:  f,
+		fresh: st.Size() == 0,
+		flush: opts.flush,
+	}
+	if len(opts.recipients) > 0 {
+		rv.enc, err = NewEncryptWriter(f, opts.recipients)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	rv.z = gzip.NewWriter(rv.compressed())
+	return rv, nil
 }
 
 type fileReader struct {
 	file *os.File
 	z    *gzip.Reader
 	e    *json.Decoder
+	// For decrypting encrypted captures.
+	identities []*Identity
+	hp         headerPeek
+	// Items read so far, for reporting truncation.
+	read int
+
+	// Where each item starts, built the first time it's needed for
+	// seeking.
+	index []indexEntry
+	// Items remaining in a range, or -1 if this isn't a range.
+	left int
+}
+
+// Items are found by the gzip member they're in (its offset in the
+// compressed stream) and where they are in that member uncompressed.
+// Members start at each flush, so seeking only decompresses from the
+// last flush before an item.  (Captures written before that have one
+// member per append, which means decompressing a lot more.)
+type indexEntry struct {
+	ts     time.Time
+	member int64
+	offset int64
 }
 
 func (f *fileReader) Close() error {
@@ -59,24 +351,244 @@ func (f *fileReader) Close() error {
 	return f.file.Close()
 }
 
+// Whether a decode error means the file just stops part way
+// through.
+func isTruncation(err error) bool {
+	return err == io.ErrUnexpectedEOF
+}
+
 func (f *fileReader) Next() (m StoredItem, err error) {
-	err = f.e.Decode(&m)
+	if f.left == 0 {
+		return m, io.EOF
+	}
+	if it, ok := f.hp.take(); ok {
+		m = it
+	} else {
+		err = f.e.Decode(&m)
+	}
+	if isTruncation(err) {
+		return m, fmt.Errorf("%v: %w after %d complete records",
+			f.file.Name(), ErrTruncated, f.read)
+	}
+	if err == nil {
+		f.read++
+		if f.left > 0 {
+			f.left--
+		}
+	}
 	return
 }
 
-func openFileReader(filepath string) (*fileReader, error) {
+func (f *fileReader) Header() (*Header, error) {
+	return f.hp.header, f.hp.err
+}
+
+// Index the file with a separate pass over it, so the position of
+// this reader isn't disturbed.
+func (f *fileReader) buildIndex() error {
+	if f.index != nil {
+		return nil
+	}
+	file, err := os.Open(f.file.Name())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	src, err := f.source(file)
+	if err != nil {
+		return err
+	}
+	c := &countingReader{r: bufio.NewReader(src)}
+	z, err := gzip.NewReader(c)
+	if err != nil {
+		return err
+	}
+	defer z.Close()
+
+	index := []indexEntry{}
+	for member := int64(0); ; member = c.n {
+		if member > 0 {
+			if err := z.Reset(c); err == io.EOF || isTruncation(err) {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+		z.Multistream(false)
+		done, err := indexMember(z, member, &index)
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+	}
+	f.index = index
+	return nil
+}
+
+// Add the items of one gzip member to an index, saying if the file
+// stops part way through it.
+func indexMember(z io.Reader, member int64, index *[]indexEntry) (bool, error) {
+	d := json.NewDecoder(z)
+	for {
+		offset := d.InputOffset()
+		var raw json.RawMessage
+		if err := d.Decode(&raw); err == io.EOF {
+			return false, nil
+		} else if isTruncation(err) {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+		if member == 0 && offset == 0 {
+			if _, ok, _ := parseHeaderRecord(raw); ok {
+				continue
+			}
+		}
+		// Keep the index ordered even if an item has no usable
+		// timestamp.
+		it := StoredItem{rawJ: &raw}
+		ts, err := it.TimestampE()
+		if err != nil && len(*index) > 0 {
+			ts = (*index)[len(*index)-1].ts
+		}
+		*index = append(*index, indexEntry{ts, member, offset})
+	}
+}
+
+// The number of items in the file, which are all read the first time
+// this is asked.
+func (f *fileReader) Len() (int, error) {
+	if err := f.buildIndex(); err != nil {
+		return 0, err
+	}
+	return len(f.index), nil
+}
+
+func (f *fileReader) search(t time.Time) int {
+	return sort.Search(len(f.index), func(i int) bool {
+		return !f.index[i].ts.Before(t)
+	})
+}
+
+// Start reading again from the ith item, decompressing from the start
+// of its gzip member.  Encrypted captures have to be decrypted from
+// the beginning to get there.
+func (f *fileReader) position(i int) error {
+	// Whatever was peeked at is behind us now.
+	f.hp.pending = nil
+	if i >= len(f.index) {
+		f.e = json.NewDecoder(strings.NewReader(""))
+		return nil
+	}
+	e := f.index[i]
+	var src io.Reader = f.file
+	if f.identities == nil {
+		if _, err := f.file.Seek(e.member, io.SeekStart); err != nil {
+			return err
+		}
+	} else {
+		if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		dec, err := f.source(f.file)
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(io.Discard, dec, e.member); err != nil {
+			return err
+		}
+		src = dec
+	}
+	if err := f.z.Reset(src); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(io.Discard, f.z, e.offset); err != nil {
+		return err
+	}
+	f.e = json.NewDecoder(f.z)
+	f.read = i
+	return nil
+}
+
+// Position the reader so Next returns the first item at or after t.
+func (f *fileReader) Seek(t time.Time) error {
+	if err := f.buildIndex(); err != nil {
+		return err
+	}
+	return f.position(f.search(t))
+}
+
+// A reader of the items from from (inclusive) to to (exclusive),
+// reading the file independently of this one.
+func (f *fileReader) Range(from, to time.Time) (Reader, error) {
+	if err := f.buildIndex(); err != nil {
+		return nil, err
+	}
+	rv, err := openFileReader(f.file.Name(), f.identities)
+	if err != nil {
+		return nil, err
+	}
+	rv.index = f.index
+	i, j := f.search(from), f.search(to)
+	if err := rv.position(i); err != nil {
+		rv.Close()
+		return nil, err
+	}
+	rv.left = 0
+	if j > i {
+		rv.left = j - i
+	}
+	return rv, nil
+}
+
+// The compressed stream of a file from its current position,
+// decrypting it if needs be.
+func (f *fileReader) source(file *os.File) (io.Reader, error) {
+	if f.identities == nil {
+		return file, nil
+	}
+	return NewDecryptReader(file, f.identities)
+}
+
+// Open a gzip capture.  Encrypted captures are decrypted with the
+// given identities, or those in the file named by $STATCAP_IDENTITY.
+func openFileReader(filepath string, identities []*Identity) (*fileReader, error) {
 	f, err := os.Open(filepath)
 	if err != nil {
 		return nil, err
 	}
 	rv := &fileReader{
 		file: f,
+		left: -1,
+	}
+	if isEncrypted(f) {
+		if len(identities) == 0 && os.Getenv(identityEnv) != "" {
+			identities, err = LoadIdentities(os.Getenv(identityEnv))
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+		if len(identities) == 0 {
+			f.Close()
+			return nil, fmt.Errorf("%v is encrypted; give an identity "+
+				"(identity= or $%v) to read it", filepath, identityEnv)
+		}
+		rv.identities = identities
+	}
+	src, err := rv.source(f)
+	if err != nil {
+		f.Close()
+		return nil, err
 	}
-	rv.z, err = gzip.NewReader(f)
+	rv.z, err = gzip.NewReader(src)
 	if err != nil {
 		f.Close()
 		return nil, err
 	}
 	rv.e = json.NewDecoder(rv.z)
+	rv.hp.peek(rv.e)
 	return rv, nil
 }
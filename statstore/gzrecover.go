@@ -0,0 +1,167 @@
+package statstore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Find where the unfinished gzip member at the end of a capture
+// starts, if there is one (the process writing it was killed).  The
+// result is the size of the file if every member is complete.
+func unfinishedMember(f *os.File) (int64, error) {
+	c := &countingReader{r: bufio.NewReader(f)}
+	z, err := gzip.NewReader(c)
+	for start := int64(0); ; start = c.n {
+		if start > 0 {
+			err = z.Reset(c)
+		}
+		switch {
+		case err == io.EOF:
+			return start, nil
+		case err == io.ErrUnexpectedEOF:
+			// Not even a whole gzip header.
+			return start, nil
+		case err != nil:
+			return 0, fmt.Errorf("%v at offset %v", err, start)
+		}
+		z.Multistream(false)
+		_, err = io.Copy(io.Discard, z)
+		if err == io.ErrUnexpectedEOF {
+			return start, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%v in the member at offset %v", err, start)
+		}
+	}
+}
+
+// Passes complete lines on, holding back a partial last one.
+type lineWriter struct {
+	w       io.Writer
+	partial []byte
+	n       int64
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	i := bytes.LastIndexByte(p, '\n')
+	if i < 0 {
+		l.partial = append(l.partial, p...)
+		return len(p), nil
+	}
+	for _, b := range [][]byte{l.partial, p[:i+1]} {
+		if _, err := l.w.Write(b); err != nil {
+			return 0, err
+		}
+		l.n += int64(len(b))
+	}
+	l.partial = append(l.partial[:0], p[i+1:]...)
+	return len(p), nil
+}
+
+// Make a gzip capture that was left unfinished safe to append to.
+// Appending after a member with no end makes everything after it
+// unreadable, so the unfinished member is replaced by a complete one
+// holding the records that made it to the file.  Those are written to
+// a temporary file first, so a crash while repairing loses nothing
+// that wasn't already lost.
+func repairGzipTail(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	start, err := unfinishedMember(f)
+	if err != nil {
+		return fmt.Errorf("can't append to %v, it's damaged: %v", path, err)
+	}
+	if start == st.Size() {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".repair")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	zw := gzip.NewWriter(tmp)
+	lw := &lineWriter{w: zw}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	// A member cut off in its header has nothing to recover.
+	if z, err := gzip.NewReader(bufio.NewReader(f)); err == nil {
+		z.Multistream(false)
+		if _, err := io.Copy(lw, z); err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("recovering the end of %v: %v", path, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	if err := f.Truncate(start); err != nil {
+		return err
+	}
+	if lw.n > 0 {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := f.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tmp); err != nil {
+			return err
+		}
+	}
+	log.Printf("%v wasn't finished; kept %v bytes of records from its last member",
+		path, lw.n)
+	return f.Sync()
+}
+
+// Check that an encrypted capture's last stream was finished.  It
+// can't be repaired without decrypting it, which whoever's appending
+// usually can't do.
+func checkEncryptedEnd(f *os.File) error {
+	r := bufio.NewReader(io.NewSectionReader(f, 0, 1<<62))
+	for {
+		header := make([]byte, len(encMagic)+2)
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return ErrTruncated
+		}
+		if string(header[:len(encMagic)]) != encMagic {
+			return errEncCorrupt
+		}
+		n := int(binary.BigEndian.Uint16(header[len(encMagic):]))
+		if _, err := r.Discard(n * encStanzaLen); err != nil {
+			return ErrTruncated
+		}
+		for last := false; !last; {
+			head := make([]byte, 5)
+			if _, err := io.ReadFull(r, head); err != nil {
+				return ErrTruncated
+			}
+			last = head[0] == 1
+			if _, err := r.Discard(int(binary.BigEndian.Uint32(head[1:]))); err != nil {
+				return ErrTruncated
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package statstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+// The version of the capture format written by this package.  Files
+// from before there were headers are format 0.
+const CaptureFormat = 1
+
+// The key of the record at the start of a gzip capture that holds
+// its header.
+const headerKey = "statcap_header"
+
+// The zip entry that holds a zip capture's header.
+const manifestName = "statcap-manifest.json"
+
+// What a capture file says about itself.
+type Header struct {
+	Format int `json:"format"`
+	// The program that wrote the capture, and its version.
+	Tool    string    `json:"tool,omitempty"`
+	Version string    `json:"version,omitempty"`
+	Created time.Time `json:"created"`
+	// The host the capture ran on.
+	Host string `json:"host,omitempty"`
+	// What was captured, and how often.
+	Server   string                 `json:"server,omitempty"`
+	Interval string                 `json:"interval,omitempty"`
+	Proto    map[string]interface{} `json:"proto,omitempty"`
+	// Anything else worth recording.
+	Extra map[string]interface{} `json:"extra,omitempty"`
+}
+
+// A header describing a capture started now by this program, on this
+// host.  Callers fill in what they're capturing.
+func NewHeader() Header {
+	h := Header{
+		Format:  CaptureFormat,
+		Tool:    filepath.Base(os.Args[0]),
+		Created: time.Now(),
+	}
+	h.Host, _ = os.Hostname()
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		h.Version = bi.Main.Version
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" {
+				h.Version += " " + s.Value
+			}
+		}
+	}
+	return h
+}
+
+// Storers that can record a header at the start of a new file.  If
+// the file isn't new (being appended to), the header isn't written.
+type headerWriter interface {
+	writeHeader(h Header) error
+}
+
+// The JSON line holding a header in a gzip capture.
+func headerRecord(h Header) ([]byte, error) {
+	b, err := json.Marshal(map[string]Header{headerKey: h})
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// If raw is a header record, the header in it.
+func parseHeaderRecord(raw json.RawMessage) (*Header, bool, error) {
+	if !bytes.Contains(raw, []byte(headerKey)) {
+		return nil, false, nil
+	}
+	m := map[string]json.RawMessage{}
+	if json.Unmarshal(raw, &m) != nil || len(m) != 1 || m[headerKey] == nil {
+		return nil, false, nil
+	}
+	h := &Header{}
+	err := json.Unmarshal(m[headerKey], h)
+	return h, true, err
+}
+
+// Reads the first record of a stream of JSON records to see whether
+// it's a header.  If it isn't, it's kept to be returned as the first
+// item.
+type headerPeek struct {
+	done    bool
+	header  *Header
+	err     error
+	pending *json.RawMessage
+}
+
+func (p *headerPeek) peek(d *json.Decoder) {
+	if p.done {
+		return
+	}
+	p.done = true
+	var raw json.RawMessage
+	// Errors (including the end) will be seen again by the next
+	// Decode.
+	if d.Decode(&raw) != nil {
+		return
+	}
+	h, ok, err := parseHeaderRecord(raw)
+	if ok {
+		p.header, p.err = h, err
+		return
+	}
+	p.pending = &raw
+}
+
+// Take the peeked first item, if it wasn't a header.
+func (p *headerPeek) take() (StoredItem, bool) {
+	if p.pending == nil {
+		return StoredItem{}, false
+	}
+	rv := StoredItem{rawJ: p.pending}
+	p.pending = nil
+	return rv, true
+}
+
+// Pull a zip capture's manifest entry out from among its other
+// entries, and read its header.
+func splitManifest(entries []zipEntry) ([]zipEntry, *Header, error) {
+	rv := entries[:0:0]
+	var h *Header
+	var herr error
+	for _, e := range entries {
+		if e.hdr.Name != manifestName {
+			rv = append(rv, e)
+			continue
+		}
+		h = &Header{}
+		r, err := e.open()
+		if err != nil {
+			herr = err
+			continue
+		}
+		b, err := io.ReadAll(r)
+		r.Close()
+		if err == nil {
+			err = json.Unmarshal(b, h)
+		}
+		herr = err
+	}
+	return rv, h, herr
+}
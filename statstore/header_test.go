@@ -0,0 +1,111 @@
+package statstore
+
+import (
+	"compress/gzip"
+	"os"
+	"testing"
+)
+
+func TestHeader(t *testing.T) {
+	for _, filename := range []string{"testheader.gz", "testheader.zip"} {
+		defer os.Remove(filename)
+
+		h := NewHeader()
+		h.Server = "localhost:11211"
+		h.Interval = "5s"
+		h.Proto = map[string]interface{}{"a": "b"}
+		fs, err := GetStorerHeader(filename, CreateNew, h)
+		if err != nil {
+			t.Fatalf("Error opening %v: %v", filename, err)
+		}
+		for i := 0; i < 3; i++ {
+			_, _, err := fs.Insert(NewItem(map[string]interface{}{"i": i},
+				itemTime(i)))
+			if err != nil {
+				t.Fatalf("Error storing item: %v", err)
+			}
+		}
+		fs.Close()
+
+		r, err := GetStoreReader(filename)
+		if err != nil {
+			t.Fatalf("Error opening %v: %v", filename, err)
+		}
+		got, err := r.Header()
+		if err != nil || got == nil {
+			t.Fatalf("Error reading header from %v: %v %v", filename, got, err)
+		}
+		if got.Format != CaptureFormat || got.Server != h.Server ||
+			got.Interval != h.Interval || got.Proto["a"] != "b" ||
+			got.Tool != h.Tool || !got.Created.Equal(h.Created) {
+			t.Errorf("Expected header %+v from %v, got %+v", h, filename, got)
+		}
+		// The header isn't an item.
+		for _, i := range []int{0, 1, 2, -1} {
+			expectNext(t, r, i)
+		}
+		r.Close()
+	}
+}
+
+func TestHeaderAppend(t *testing.T) {
+	filename := "testheaderappend.gz"
+	defer os.Remove(filename)
+
+	writeItems(t, filename, 0)
+	fs, err := GetStorerMode(filename, Append)
+	if err != nil {
+		t.Fatalf("Error reopening %v: %v", filename, err)
+	}
+	fs.Insert(NewItem(map[string]interface{}{"i": 1}, itemTime(1)))
+	fs.Close()
+
+	// Appending doesn't add a second header in the middle.
+	r, err := GetStoreReader(filename)
+	if err != nil {
+		t.Fatalf("Error opening %v: %v", filename, err)
+	}
+	defer r.Close()
+	if h, err := r.Header(); h == nil || err != nil {
+		t.Fatalf("Expected a header, got %v %v", h, err)
+	}
+	for _, i := range []int{0, 1, -1} {
+		expectNext(t, r, i)
+	}
+}
+
+func TestNoHeader(t *testing.T) {
+	gzname, zipname := "testnoheader.gz", "testnoheader.zip"
+	defer os.Remove(gzname)
+	defer os.Remove(zipname)
+
+	// Captures written before there were headers.
+	f, err := os.Create(gzname)
+	if err != nil {
+		t.Fatalf("Error creating %v: %v", gzname, err)
+	}
+	z := gzip.NewWriter(f)
+	z.Write([]byte(`{"i": 0, "ts": "2012-06-14T04:02:34Z"}` + "\n" +
+		`{"i": 1, "ts": "2012-06-14T04:02:35Z"}` + "\n"))
+	z.Close()
+	f.Close()
+
+	writeRawZip(t, zipname, []rawZipEntry{
+		{0, itemTime(0).Local().Format(timeFormat), ""},
+		{1, itemTime(1).Local().Format(timeFormat), ""},
+	})
+
+	for _, filename := range []string{gzname, zipname} {
+		r, err := GetStoreReader(filename)
+		if err != nil {
+			t.Fatalf("Error opening %v: %v", filename, err)
+		}
+		if h, err := r.Header(); h != nil || err != nil {
+			t.Errorf("Expected no header in %v, got %v %v", filename, h, err)
+		}
+		for _, i := range []int{0, 1, -1} {
+			expectNext(t, r, i)
+		}
+		r.Close()
+	}
+}
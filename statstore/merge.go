@@ -0,0 +1,274 @@
+package statstore
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The next item from one of the readers being merged.
+type mergeInput struct {
+	r    Reader
+	name string
+	// Position among the inputs, so items with the same time come
+	// out in a stable order.
+	index int
+	item  StoredItem
+	ts    time.Time
+	// Set when the item has no usable timestamp.  It's placed at
+	// the time of the item before it, and reported when it comes out.
+	err error
+}
+
+type mergeHeap []*mergeInput
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].ts.Equal(h[j].ts) {
+		return h[i].index < h[j].index
+	}
+	return h[i].ts.Before(h[j].ts)
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeInput)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	rv := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return rv
+}
+
+// Reads several time ordered readers as one, in time order.
+type mergeReader struct {
+	inputs  []*mergeInput
+	h       mergeHeap
+	started bool
+	dedup   bool
+
+	// The items already returned with the current timestamp, for
+	// dropping duplicates.
+	lastTS time.Time
+	seen   map[string]bool
+}
+
+// Merge readers (each of which must be in time order) into a single
+// reader in time order.  Items with the same time come out in the
+// order their readers were given.  With dedup, an item identical to
+// one already returned with the same time is dropped, e.g. where
+// captures overlap.
+//
+// If a reader fails, its error is returned and the merge carries on
+// without it.
+func NewMergeReader(readers []Reader, dedup bool) Reader {
+	rv := &mergeReader{dedup: dedup}
+	for i, r := range readers {
+		rv.inputs = append(rv.inputs, &mergeInput{r: r, index: i})
+	}
+	return rv
+}
+
+// Read an input's next item, putting it back in the heap unless it's
+// done.
+func (m *mergeReader) advance(in *mergeInput) error {
+	it, err := in.r.Next()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return in.wrap(err)
+	}
+	in.item = it
+	ts, err := it.TimestampE()
+	if err != nil {
+		in.err = in.wrap(err)
+	} else {
+		in.ts = ts
+	}
+	heap.Push(&m.h, in)
+	return nil
+}
+
+func (in *mergeInput) wrap(err error) error {
+	if in.name != "" {
+		return fmt.Errorf("%v: %w", in.name, err)
+	}
+	return err
+}
+
+// Read the first item of every input.  One that fails is left out,
+// but the rest are still started.
+func (m *mergeReader) start() error {
+	m.started = true
+	var errs []error
+	for _, in := range m.inputs {
+		if err := m.advance(in); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// An item's content in a form that's the same whatever format it was
+// read from.  Zip captures keep the timestamp outside the document,
+// so it's left out (duplicates are only looked for among items with
+// the same time anyway).
+func canonicalItem(it StoredItem) ([]byte, error) {
+	b, err := it.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	delete(m, "ts")
+	return json.Marshal(m)
+}
+
+// Whether an item was already returned.
+func (m *mergeReader) duplicate(in *mergeInput) (bool, error) {
+	if !in.ts.Equal(m.lastTS) || m.seen == nil {
+		m.lastTS = in.ts
+		m.seen = map[string]bool{}
+	}
+	b, err := canonicalItem(in.item)
+	if err != nil {
+		return false, err
+	}
+	if m.seen[string(b)] {
+		return true, nil
+	}
+	m.seen[string(b)] = true
+	return false, nil
+}
+
+func (m *mergeReader) Next() (StoredItem, error) {
+	if !m.started {
+		if err := m.start(); err != nil {
+			return StoredItem{}, err
+		}
+	}
+	for m.h.Len() > 0 {
+		in := heap.Pop(&m.h).(*mergeInput)
+		it := in.item
+		dup := false
+		err := in.err
+		in.err = nil
+		if m.dedup && err == nil {
+			dup, err = m.duplicate(in)
+		}
+		if aerr := m.advance(in); aerr != nil {
+			err = errors.Join(err, aerr)
+		}
+		if err != nil {
+			return it, err
+		}
+		if !dup {
+			return it, nil
+		}
+	}
+	return StoredItem{}, io.EOF
+}
+
+// The header of the first of the merged captures that has one.
+func (m *mergeReader) Header() (*Header, error) {
+	for _, in := range m.inputs {
+		if h, err := in.r.Header(); h != nil || err != nil {
+			return h, err
+		}
+	}
+	return nil, nil
+}
+
+func (m *mergeReader) Close() (err error) {
+	for _, in := range m.inputs {
+		if e := in.r.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// Whether a path looks like a glob rather than a file name.
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// Expand a comma separated list of file names and globs.  Each glob's
+// matches are taken in name order, which is time order for rotated
+// captures.
+func expandPaths(list string) ([]string, error) {
+	rv := []string{}
+	for _, p := range strings.Split(list, ",") {
+		if p == "" {
+			continue
+		}
+		if !isGlob(p) {
+			rv = append(rv, p)
+			continue
+		}
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no captures match %v", p)
+		}
+		sort.Strings(matches)
+		rv = append(rv, matches...)
+	}
+	if len(rv) == 0 {
+		return nil, fmt.Errorf("no captures given")
+	}
+	return rv, nil
+}
+
+// Open and merge a comma separated list of captures and globs of
+// captures (gzip and zip can be mixed).
+func OpenMergeReader(list string, dedup bool) (Reader, error) {
+	paths, err := expandPaths(list)
+	if err != nil {
+		return nil, err
+	}
+	readers := []Reader{}
+	for _, p := range paths {
+		r, err := GetStoreReader(p)
+		if err != nil {
+			for _, r := range readers {
+				r.Close()
+			}
+			return nil, fmt.Errorf("%v: %w", p, err)
+		}
+		readers = append(readers, r)
+	}
+	rv := NewMergeReader(readers, dedup).(*mergeReader)
+	for i, p := range paths {
+		rv.inputs[i].name = p
+	}
+	return rv, nil
+}
+
+// Open a merge: URL, e.g. merge:caps/*.gz,other.zip?dedup=true.
+// Since ? starts the query, it can't be used in the globs.
+func openMergeURL(u *url.URL) (Reader, error) {
+	dedup := false
+	if s := u.Query().Get("dedup"); s != "" {
+		var err error
+		if dedup, err = strconv.ParseBool(s); err != nil {
+			return nil, err
+		}
+	}
+	return OpenMergeReader(urlPath(u), dedup)
+}
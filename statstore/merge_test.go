@@ -0,0 +1,147 @@
+package statstore
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// Store items (identified by their time) in a capture.
+func writeItems(t *testing.T, filename string, items ...int) {
+	fs, err := GetStorer(filename)
+	if err != nil {
+		t.Fatalf("Error opening %v: %v", filename, err)
+	}
+	defer fs.Close()
+	for _, i := range items {
+		_, _, err := fs.Insert(NewItem(map[string]interface{}{"i": i},
+			itemTime(i)))
+		if err != nil {
+			t.Fatalf("Error storing item: %v", err)
+		}
+	}
+}
+
+func readItems(t *testing.T, path string) []int {
+	r, err := GetStoreReader(path)
+	if err != nil {
+		t.Fatalf("Error opening %v: %v", path, err)
+	}
+	defer r.Close()
+	rv := []int{}
+	for {
+		it, err := r.Next()
+		if err == io.EOF {
+			return rv
+		}
+		if err != nil {
+			t.Fatalf("Error reading %v: %v", path, err)
+		}
+		m := map[string]interface{}{}
+		if err := it.UnmarshalInto(&m); err != nil {
+			t.Fatalf("Error decoding item: %v", err)
+		}
+		rv = append(rv, int(m["i"].(float64)))
+	}
+}
+
+func TestMergeReader(t *testing.T) {
+	files := map[string][]int{
+		"testmerge-a.gz":  {0, 3, 4, 8},
+		"testmerge-b.gz":  {1, 4, 5},
+		"testmerge-c.zip": {2, 6, 7, 8},
+	}
+	for filename, items := range files {
+		defer os.Remove(filename)
+		writeItems(t, filename, items...)
+	}
+
+	tests := []struct {
+		path string
+		exp  []int
+	}{
+		{"testmerge-*", []int{0, 1, 2, 3, 4, 4, 5, 6, 7, 8, 8}},
+		{"merge:testmerge-*?dedup=true", []int{0, 1, 2, 3, 4, 5, 6, 7, 8}},
+		{"merge:testmerge-b.gz,testmerge-[c].zip",
+			[]int{1, 2, 4, 5, 6, 7, 8}},
+		{"merge:testmerge-a.gz", []int{0, 3, 4, 8}},
+	}
+	for _, test := range tests {
+		if got := readItems(t, test.path); !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%v: expected %v, got %v", test.path, test.exp, got)
+		}
+	}
+
+	for _, path := range []string{"testmerge-nothing*", "merge:",
+		"merge:testmerge-a.gz,testmerge-missing.gz"} {
+		if r, err := GetStoreReader(path); err == nil {
+			r.Close()
+			t.Errorf("Expected an error opening %v", path)
+		}
+	}
+}
+
+func TestMergeBadTimestamp(t *testing.T) {
+	good, bad := "testmergebad-a.gz", "testmergebad-b.gz"
+	defer os.Remove(good)
+	defer os.Remove(bad)
+	writeItems(t, good, 0, 2)
+
+	f, err := os.Create(bad)
+	if err != nil {
+		t.Fatalf("Error creating %v: %v", bad, err)
+	}
+	z := gzip.NewWriter(f)
+	z.Write([]byte(`{"i": 1, "ts": "2012-06-14T04:02:35Z"}` + "\n" +
+		`{"i": 9, "ts": "not a time"}` + "\n" +
+		`{"i": 3, "ts": "2012-06-14T04:02:37Z"}` + "\n"))
+	z.Close()
+	f.Close()
+
+	r, err := GetStoreReader("merge:" + good + "," + bad)
+	if err != nil {
+		t.Fatalf("Error opening merge: %v", err)
+	}
+	defer r.Close()
+	expectNext(t, r, 0)
+	expectNext(t, r, 1)
+	// The bad one is reported in place, and the merge carries on.
+	if _, err := r.Next(); err == nil {
+		t.Fatalf("Expected an error for the bad timestamp")
+	}
+	expectNext(t, r, 2)
+	expectNext(t, r, 3)
+	expectNext(t, r, -1)
+}
+
+// A reader that can't be read.
+type failingReader struct{ err error }
+
+func (f failingReader) Next() (StoredItem, error) { return StoredItem{}, f.err }
+func (f failingReader) Header() (*Header, error)  { return nil, nil }
+func (f failingReader) Close() error              { return nil }
+
+func TestMergeFailingInput(t *testing.T) {
+	good := "testmergefail.gz"
+	defer os.Remove(good)
+	writeItems(t, good, 0, 1, 2)
+
+	r, err := GetStoreReader(good)
+	if err != nil {
+		t.Fatalf("Error opening %v: %v", good, err)
+	}
+	boom := errors.New("boom")
+	m := NewMergeReader([]Reader{failingReader{boom}, r}, false)
+	defer m.Close()
+
+	if _, err := m.Next(); !errors.Is(err, boom) {
+		t.Fatalf("Expected the failure first, got %v", err)
+	}
+	// The inputs after the failed one carry on.
+	for _, i := range []int{0, 1, 2, -1} {
+		expectNext(t, m, i)
+	}
+}
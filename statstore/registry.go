@@ -0,0 +1,159 @@
+package statstore
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Opens a Storer for a URL whose scheme it was registered under.
+type StorerOpener func(u *url.URL) (Storer, error)
+
+// Opens a Reader for a URL whose scheme it was registered under.
+type ReaderOpener func(u *url.URL) (Reader, error)
+
+type backend struct {
+	storer StorerOpener
+	reader ReaderOpener
+}
+
+var registryLock sync.RWMutex
+var registry = map[string]backend{}
+
+// Register a backend for URLs of the form scheme:...  Either opener
+// may be nil if the backend can't write or can't read.  Registering
+// a scheme again replaces the previous registration.
+func Register(scheme string, openStorer StorerOpener, openReader ReaderOpener) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry[scheme] = backend{openStorer, openReader}
+}
+
+var schemeRE = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:`)
+
+// Find the registered backend for a path, if it has a registered
+// scheme.
+func lookupBackend(path string) (*url.URL, backend, bool) {
+	if !schemeRE.MatchString(path) {
+		return nil, backend{}, false
+	}
+	u, err := url.Parse(path)
+	if err != nil {
+		// File name templates have things like %Y in them.
+		u, err = url.Parse(escapePercents(path))
+		if err != nil {
+			return nil, backend{}, false
+		}
+	}
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	b, ok := registry[u.Scheme]
+	return u, b, ok
+}
+
+// Escape literal %s before any query string.
+func escapePercents(path string) string {
+	q := ""
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, q = path[:i], path[i:]
+	}
+	return strings.Replace(path, "%", "%25", -1) + q
+}
+
+// The filesystem path in a URL such as file:/tmp/x.gz,
+// file:///tmp/x.gz or file:relative.gz.
+func urlPath(u *url.URL) string {
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+	return u.Path
+}
+
+func openRegisteredStorer(u *url.URL, b backend) (Storer, error) {
+	if b.storer == nil {
+		return nil, fmt.Errorf("statstore: can't write to %q URLs", u.Scheme)
+	}
+	return b.storer(u)
+}
+
+func openRegisteredReader(u *url.URL, b backend) (Reader, error) {
+	if b.reader == nil {
+		return nil, fmt.Errorf("statstore: can't read from %q URLs", u.Scheme)
+	}
+	return b.reader(u)
+}
+
+// Open a file-backed storer, rotating if the URL asks for it.
+func openRotatable(u *url.URL,
+	open func(path string, mode Mode) (rotatable, error)) (Storer, error) {
+
+	mode, err := parseMode(u.Query().Get("mode"))
+	if err != nil {
+		return nil, err
+	}
+	opts, rotate, err := rotateOptionsFromURL(u)
+	if err != nil {
+		return nil, err
+	}
+	if rotate {
+		opts.mode = mode
+		return newRotatingStorer(opts, open), nil
+	}
+	return open(urlPath(u), mode)
+}
+
+func init() {
+	Register("file",
+		func(u *url.URL) (Storer, error) {
+			opts, err := fileOptionsFromURL(u)
+			if err != nil {
+				return nil, err
+			}
+			return openRotatable(u, func(path string,
+				mode Mode) (rotatable, error) {
+				return openFileStorer(path, mode, opts)
+			})
+		},
+		func(u *url.URL) (Reader, error) {
+			ids, err := identitiesFromURL(u)
+			if err != nil {
+				return nil, err
+			}
+			return openFileReader(urlPath(u), ids)
+		})
+	Register("zip",
+		func(u *url.URL) (Storer, error) {
+			return openRotatable(u, func(path string,
+				mode Mode) (rotatable, error) {
+				return openZipStorer(path, mode)
+			})
+		},
+		func(u *url.URL) (Reader, error) {
+			return openZipReader(urlPath(u))
+		})
+	Register("merge", nil, openMergeURL)
+	Register("stdout",
+		func(u *url.URL) (Storer, error) {
+			return openStdoutStorer(u)
+		}, nil)
+	Register("stdin", nil,
+		func(u *url.URL) (Reader, error) {
+			return openStdinReader()
+		})
+	for _, scheme := range []string{"http", "https"} {
+		scheme := scheme
+		Register("couch+"+scheme,
+			func(u *url.URL) (Storer, error) {
+				cu := *u
+				cu.Scheme = scheme
+				return openCouchStorer(cu.String())
+			},
+			func(u *url.URL) (Reader, error) {
+				cu := *u
+				cu.Scheme = scheme
+				return openCouchReader(cu.String())
+			})
+	}
+}
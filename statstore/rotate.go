@@ -0,0 +1,264 @@
+package statstore
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A storer that writes to a file whose size we can check.  The size
+// is what's reached the file so far, so it lags behind whatever the
+// compressor is still holding.
+type rotatable interface {
+	Storer
+	size() (int64, error)
+}
+
+// When and how to start a new file.
+type rotateOptions struct {
+	// File name, with strftime-style %Y %m %d %H %M %S (and %%)
+	// filled in from the first timestamp going into the file.
+	template string
+	maxSize  int64
+	maxAge   time.Duration
+	// "hourly" or "daily" to start a new file on the wall clock
+	// boundary.
+	every string
+	// Command run with each finished file's name as its argument.
+	hook string
+	// Appending continues an existing file with the same name,
+	// otherwise a new name is found.
+	mode Mode
+}
+
+// Writes to a series of files, starting a new one whenever the
+// current one is too big, too old, or crosses an hour or day
+// boundary.  Each file is closed (and so complete and readable)
+// before the next is started.
+type rotatingStorer struct {
+	lock sync.Mutex
+	opts rotateOptions
+	open func(path string, mode Mode) (rotatable, error)
+
+	cur     rotatable
+	curPath string
+	started time.Time
+
+	// Written at the start of each file, if we were given one.
+	header *Header
+
+	// Hooks still running, which Close waits for so the last file
+	// is handed off before the program exits.
+	hooks sync.WaitGroup
+}
+
+var strftimeLayouts = map[byte]string{
+	'Y': "2006", 'm': "01", 'd': "02", 'H': "15", 'M': "04", 'S': "05",
+}
+
+// Fill in a file name template.
+func expandTemplate(template string, ts time.Time) string {
+	var b strings.Builder
+	for i := 0; i < len(template); i++ {
+		if template[i] == '%' && i+1 < len(template) {
+			c := template[i+1]
+			if layout, ok := strftimeLayouts[c]; ok {
+				b.WriteString(ts.Format(layout))
+				i++
+				continue
+			}
+			if c == '%' {
+				b.WriteByte('%')
+				i++
+				continue
+			}
+		}
+		b.WriteByte(template[i])
+	}
+	return b.String()
+}
+
+// A name based on path that isn't already taken, made by adding -1,
+// -2 ... before the extension(s).
+func uniqueName(path string) string {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return path
+	}
+	dir, base := filepath.Split(path)
+	ext := ""
+	if i := strings.Index(base, "."); i > 0 {
+		base, ext = base[:i], base[i:]
+	}
+	for n := 1; ; n++ {
+		p := filepath.Join(dir, fmt.Sprintf("%s-%d%s", base, n, ext))
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			return p
+		}
+	}
+}
+
+func sameBoundary(every string, a, b time.Time) bool {
+	switch every {
+	case "hourly":
+		return a.Format("2006010215") == b.Format("2006010215")
+	case "daily":
+		return a.Format("20060102") == b.Format("20060102")
+	}
+	return true
+}
+
+func (r *rotatingStorer) needsRotation(ts time.Time) bool {
+	if r.opts.maxSize > 0 {
+		if sz, err := r.cur.size(); err == nil && sz >= r.opts.maxSize {
+			return true
+		}
+	}
+	if r.opts.maxAge > 0 && ts.Sub(r.started) >= r.opts.maxAge {
+		return true
+	}
+	return !sameBoundary(r.opts.every, r.started, ts)
+}
+
+// Close the current file and hand it to the hook.
+func (r *rotatingStorer) finish() error {
+	err := r.cur.Close()
+	path := r.curPath
+	r.cur, r.curPath = nil, ""
+
+	if r.opts.hook != "" && err == nil {
+		r.hooks.Add(1)
+		go func() {
+			defer r.hooks.Done()
+			out, err := exec.Command(r.opts.hook, path).CombinedOutput()
+			if err != nil {
+				log.Printf("Error running %v %v: %v\n%s",
+					r.opts.hook, path, err, out)
+			}
+		}()
+	}
+	return err
+}
+
+func (r *rotatingStorer) Insert(ob StoredItem) (string, string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ts, err := ob.TimestampE()
+	if err != nil {
+		return "", "", err
+	}
+	if r.cur != nil && r.needsRotation(ts) {
+		if err := r.finish(); err != nil {
+			return "", "", err
+		}
+	}
+	if r.cur == nil {
+		path := expandTemplate(r.opts.template, ts)
+		mode := r.opts.mode
+		if mode != Append {
+			path, mode = uniqueName(path), CreateNew
+		}
+		cur, err := r.open(path, mode)
+		if err != nil {
+			return "", "", err
+		}
+		r.cur, r.curPath, r.started = cur, path, ts
+
+		if hw, ok := cur.(headerWriter); ok && r.header != nil {
+			h := *r.header
+			h.Created = time.Now()
+			if err := hw.writeHeader(h); err != nil {
+				return "", "", err
+			}
+		}
+	}
+
+	_, _, err = r.cur.Insert(ob)
+	return r.curPath, "", err
+}
+
+// Files aren't opened until there's something to put in them, so the
+// header is kept until then.
+func (r *rotatingStorer) writeHeader(h Header) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.header = &h
+	return nil
+}
+
+func (r *rotatingStorer) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var err error
+	if r.cur != nil {
+		err = r.finish()
+	}
+	r.hooks.Wait()
+	return err
+}
+
+// Parse a size such as 1048576, 512k, 100MB or 2G.
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	u := strings.TrimSuffix(strings.ToUpper(s), "B")
+	switch {
+	case strings.HasSuffix(u, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(u, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(u, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		u = u[:len(u)-1]
+	}
+	n, err := strconv.ParseInt(u, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return n * mult, nil
+}
+
+// Read rotation options from the query parameters of a file: or
+// zip: URL (rotate=hourly|daily, maxsize, maxage and hook).  Returns
+// false if no rotation was asked for.
+func rotateOptionsFromURL(u *url.URL) (rotateOptions, bool, error) {
+	q := u.Query()
+	rv := rotateOptions{
+		template: urlPath(u),
+		every:    q.Get("rotate"),
+		hook:     q.Get("hook"),
+	}
+	switch rv.every {
+	case "", "hourly", "daily":
+	default:
+		return rv, false, fmt.Errorf("invalid rotate: %q", rv.every)
+	}
+	var err error
+	if s := q.Get("maxsize"); s != "" {
+		if rv.maxSize, err = parseSize(s); err != nil {
+			return rv, false, err
+		}
+	}
+	if s := q.Get("maxage"); s != "" {
+		if rv.maxAge, err = time.ParseDuration(s); err != nil {
+			return rv, false, err
+		}
+	}
+	return rv, rv.every != "" || rv.maxSize > 0 || rv.maxAge > 0, nil
+}
+
+func newRotatingStorer(opts rotateOptions,
+	open func(path string, mode Mode) (rotatable, error)) *rotatingStorer {
+
+	return &rotatingStorer{opts: opts, open: open}
+}
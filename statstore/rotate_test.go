@@ -0,0 +1,149 @@
+package statstore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	ts := time.Date(2012, 6, 14, 3, 4, 5, 0, time.UTC)
+	got := expandTemplate("cap-%Y%m%d-%H%M%S-100%%-%x.json.gz", ts)
+	exp := "cap-20120614-030405-100%-%x.json.gz"
+	if got != exp {
+		t.Fatalf("Expected %v, got %v", exp, got)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"1048576": 1048576,
+		"512k":    512 << 10,
+		"100MB":   100 << 20,
+		"2G":      2 << 30,
+	}
+	for in, exp := range tests {
+		if got, err := parseSize(in); err != nil || got != exp {
+			t.Errorf("Expected %v for %v, got %v/%v", exp, in, got, err)
+		}
+	}
+	if _, err := parseSize("lots"); err == nil {
+		t.Errorf("Expected error parsing nonsense size")
+	}
+}
+
+func countItems(t *testing.T, path string) int {
+	r, err := GetStoreReader(path)
+	if err != nil {
+		t.Fatalf("Error opening %v: %v", path, err)
+	}
+	defer r.Close()
+	n := 0
+	for {
+		_, err := r.Next()
+		if err == io.EOF {
+			return n
+		}
+		if err != nil {
+			t.Fatalf("Error reading %v: %v", path, err)
+		}
+		n++
+	}
+}
+
+func TestHourlyRotation(t *testing.T) {
+	for _, ext := range []string{"json.gz", "zip"} {
+		dir, err := os.MkdirTemp("", "rotate")
+		if err != nil {
+			t.Fatalf("Error making temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		hooked := filepath.Join(dir, "hooked")
+		hook := filepath.Join(dir, "hook.sh")
+		err = os.WriteFile(hook,
+			[]byte("#!/bin/sh\necho $1 >> "+hooked+"\n"), 0755)
+		if err != nil {
+			t.Fatalf("Error writing hook: %v", err)
+		}
+
+		scheme := "file:"
+		if ext == "zip" {
+			scheme = "zip:"
+		}
+		start := time.Date(2012, 6, 14, 3, 40, 0, 0, time.Local)
+		s, err := GetStorer(scheme + dir + "/cap-%Y%m%d-%H." + ext +
+			"?rotate=hourly&hook=" + hook)
+		if err != nil {
+			t.Fatalf("Error opening storer: %v", err)
+		}
+		// 3:40 through 5:10, every ten minutes.
+		for i := 0; i < 10; i++ {
+			ts := start.Add(time.Duration(i) * 10 * time.Minute)
+			_, _, err := s.Insert(NewItem(map[string]interface{}{"i": i}, ts))
+			if err != nil {
+				t.Fatalf("Error inserting: %v", err)
+			}
+		}
+		if err := s.Close(); err != nil {
+			t.Fatalf("Error closing: %v", err)
+		}
+
+		counts := map[string]int{}
+		for _, h := range []string{"03", "04", "05"} {
+			p := dir + "/cap-20120614-" + h + "." + ext
+			counts[h] = countItems(t, p)
+		}
+		exp := map[string]int{"03": 2, "04": 6, "05": 2}
+		if !reflect.DeepEqual(counts, exp) {
+			t.Fatalf("Expected %v, got %v", exp, counts)
+		}
+
+		// Hooks run in the background, but Close waits for them.
+		b, _ := os.ReadFile(hooked)
+		lines := strings.Fields(string(b))
+		sort.Strings(lines)
+		if len(lines) != 3 || !strings.HasSuffix(lines[0], "-03."+ext) {
+			t.Fatalf("Expected the hook to see three files, got %v", lines)
+		}
+	}
+}
+
+func TestSizeRotation(t *testing.T) {
+	dir, err := os.MkdirTemp("", "rotate")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := GetStorer("zip:" + dir + "/cap.zip?maxsize=1k")
+	if err != nil {
+		t.Fatalf("Error opening storer: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		ts := basetime.Add(time.Duration(i) * time.Second)
+		_, _, err := s.Insert(NewItem(map[string]interface{}{
+			"i": i, "pad": strings.Repeat("x", 100)}, ts))
+		if err != nil {
+			t.Fatalf("Error inserting: %v", err)
+		}
+	}
+	s.Close()
+
+	files, _ := filepath.Glob(dir + "/cap*.zip")
+	if len(files) < 2 {
+		t.Fatalf("Expected several files, got %v", files)
+	}
+	total := 0
+	for _, f := range files {
+		total += countItems(t, f)
+	}
+	if total != 100 {
+		t.Fatalf("Expected 100 items across %v, got %v", files, total)
+	}
+}
@@ -0,0 +1,208 @@
+package statstore
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func itemTime(i int) time.Time {
+	return basetime.Add(time.Duration(i) * time.Second)
+}
+
+func expectNext(t *testing.T, r Reader, i int) {
+	it, err := r.Next()
+	if i < 0 {
+		if err != io.EOF {
+			t.Fatalf("Expected EOF, got %v", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("Error reading item %v: %v", i, err)
+	}
+	if !it.Timestamp().Equal(itemTime(i)) {
+		t.Fatalf("Expected item %v, got one from %v", i, it.Timestamp())
+	}
+}
+
+func TestSeekableReaders(t *testing.T) {
+	for _, filename := range []string{"testseek.gz", "testseek.zip"} {
+		defer os.Remove(filename)
+		func() {
+			fs, err := GetStorer(filename)
+			if err != nil {
+				t.Fatalf("Error opening storer: %v", err)
+			}
+			defer fs.Close()
+			for i := 0; i < 10; i++ {
+				_, _, err := fs.Insert(NewItem(
+					map[string]interface{}{"i": i}, itemTime(i)))
+				if err != nil {
+					t.Fatalf("Error storing item: %v", err)
+				}
+			}
+		}()
+
+		r, err := GetStoreReader(filename)
+		if err != nil {
+			t.Fatalf("Error opening reader: %v", err)
+		}
+		defer r.Close()
+
+		sr, ok := r.(SeekableReader)
+		if !ok {
+			t.Fatalf("%v reader isn't seekable", filename)
+		}
+
+		expectNext(t, sr, 0)
+		if n, err := sr.Len(); err != nil || n != 10 {
+			t.Fatalf("Expected 10 items in %v, got %v/%v", filename, n, err)
+		}
+		// Reading carries on from where it was.
+		expectNext(t, sr, 1)
+
+		if err := sr.Seek(itemTime(7)); err != nil {
+			t.Fatalf("Error seeking: %v", err)
+		}
+		expectNext(t, sr, 7)
+		expectNext(t, sr, 8)
+
+		// Between items, and backwards.
+		sr.Seek(itemTime(2).Add(time.Millisecond))
+		expectNext(t, sr, 3)
+
+		sr.Seek(itemTime(20))
+		expectNext(t, sr, -1)
+
+		rr, err := sr.Range(itemTime(4), itemTime(7))
+		if err != nil {
+			t.Fatalf("Error getting range: %v", err)
+		}
+		for i := 4; i < 7; i++ {
+			expectNext(t, rr, i)
+		}
+		expectNext(t, rr, -1)
+		rr.Close()
+
+		rr, _ = sr.Range(itemTime(7), itemTime(4))
+		expectNext(t, rr, -1)
+		rr.Close()
+	}
+}
+
+func TestSeekMembers(t *testing.T) {
+	filename := "testseekmembers.gz"
+	defer os.Remove(filename)
+
+	// A gzip member per flush, so seeking can start from one.
+	items := []int{}
+	for i := 0; i < 10; i++ {
+		items = append(items, i)
+	}
+	writeItems(t, "file:"+filename+"?flushrecords=3", items...)
+	writeItems(t, "file:"+filename+"?mode=append", 10, 11)
+
+	r, err := openFileReader(filename, nil)
+	if err != nil {
+		t.Fatalf("Error opening %v: %v", filename, err)
+	}
+	defer r.Close()
+	if n, err := r.Len(); err != nil || n != 12 {
+		t.Fatalf("Expected 12 items, got %v/%v", n, err)
+	}
+	members := map[int64]bool{}
+	for _, e := range r.index {
+		members[e.member] = true
+	}
+	if len(members) != 5 {
+		t.Errorf("Expected 5 gzip members, got %v", len(members))
+	}
+
+	for _, i := range []int{7, 2, 10, 0, 9} {
+		if err := r.Seek(itemTime(i)); err != nil {
+			t.Fatalf("Error seeking to %v: %v", i, err)
+		}
+		expectNext(t, r, i)
+		expectNext(t, r, i+1)
+	}
+}
+
+type rawZipEntry struct {
+	i         int
+	name, tag string
+}
+
+// Write zip entries in the given order, the way zipStorer does, but
+// optionally without the time tag.
+func writeRawZip(t *testing.T, filename string, entries []rawZipEntry) {
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Error creating %v: %v", filename, err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, e := range entries {
+		h := zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		if e.tag != "" {
+			h.Extra = []byte{0, 0, 0, 0}
+			binary.LittleEndian.PutUint16(h.Extra[0:2], timeTag)
+			binary.LittleEndian.PutUint16(h.Extra[2:4], uint16(len(e.tag)))
+			h.Extra = append(h.Extra, e.tag...)
+		}
+		w, err := zw.CreateHeader(&h)
+		if err != nil {
+			t.Fatalf("Error creating entry: %v", err)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ts": itemTime(e.i), "i": e.i})
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Error closing zip: %v", err)
+	}
+}
+
+func TestZipReaderOrder(t *testing.T) {
+	filename := "testorder.zip"
+	defer os.Remove(filename)
+
+	tagged := func(i int) rawZipEntry {
+		ts := itemTime(i)
+		return rawZipEntry{i, ts.Format(timeFormat), ts.Format(time.RFC3339Nano)}
+	}
+	named := func(i int) rawZipEntry {
+		return rawZipEntry{i, itemTime(i).Local().Format(timeFormat), ""}
+	}
+
+	writeRawZip(t, filename, []rawZipEntry{
+		tagged(3),
+		{9, "whatever.json", ""},
+		named(1),
+		tagged(0),
+		// A bad tag falls back to the name.
+		{2, itemTime(2).Local().Format(timeFormat), "not a time"},
+		tagged(4),
+		tagged(3),
+	})
+
+	r, err := GetStoreReader(filename)
+	if err != nil {
+		t.Fatalf("Error opening reader: %v", err)
+	}
+	defer r.Close()
+
+	// The duplicate 3 is dropped, and the entry with no time comes
+	// last.
+	for _, i := range []int{0, 1, 2, 3, 4, 9, -1} {
+		expectNext(t, r, i)
+	}
+
+	sr := r.(SeekableReader)
+	sr.Seek(itemTime(2))
+	expectNext(t, sr, 2)
+	expectNext(t, sr, 3)
+}
@@ -0,0 +1,80 @@
+package statstore
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// Writes one JSON document per line (or indented documents if
+// pretty) to a stream, usually stdout.
+type streamStorer struct {
+	lock sync.Mutex
+	e    *json.Encoder
+}
+
+func (s *streamStorer) Insert(ob StoredItem) (string, string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Add a timestamp if there isn't one.
+	b, err := ob.jsonWithTS()
+	if err != nil {
+		return "", "", err
+	}
+	return "", "", s.e.Encode(json.RawMessage(b))
+}
+
+func (s *streamStorer) Close() error {
+	return nil
+}
+
+func newStreamStorer(w io.Writer, pretty bool) *streamStorer {
+	e := json.NewEncoder(w)
+	if pretty {
+		e.SetIndent("", "  ")
+	}
+	return &streamStorer{e: e}
+}
+
+// Open a storer for stdout:, stdout:pretty or stdout:?pretty=true
+func openStdoutStorer(u *url.URL) (*streamStorer, error) {
+	pretty := u.Opaque == "pretty" || u.Query().Get("pretty") == "true"
+	return newStreamStorer(os.Stdout, pretty), nil
+}
+
+// Reads a stream of plain (uncompressed) JSON documents.
+type streamReader struct {
+	d  *json.Decoder
+	hp headerPeek
+}
+
+func (s *streamReader) Next() (m StoredItem, err error) {
+	s.hp.peek(s.d)
+	if it, ok := s.hp.take(); ok {
+		return it, nil
+	}
+	err = s.d.Decode(&m)
+	return
+}
+
+// Streams usually don't have a header, but a gzip capture piped
+// through zcat does.  Reading it waits for the first record.
+func (s *streamReader) Header() (*Header, error) {
+	s.hp.peek(s.d)
+	return s.hp.header, s.hp.err
+}
+
+func (s *streamReader) Close() error {
+	return nil
+}
+
+func newStreamReader(r io.Reader) *streamReader {
+	return &streamReader{d: json.NewDecoder(r)}
+}
+
+func openStdinReader() (*streamReader, error) {
+	return newStreamReader(os.Stdin), nil
+}
@@ -2,10 +2,14 @@ package statstore
 
 import (
 	"archive/zip"
+	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"io"
+	"net/url"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -31,6 +35,15 @@ func TestFileStorer(t *testing.T) {
 	}
 	d := json.NewDecoder(z)
 
+	// The header comes first.
+	hr := map[string]Header{}
+	if err := d.Decode(&hr); err != nil {
+		t.Fatalf("Error reading the header: %v", err)
+	}
+	if hr[headerKey].Format != CaptureFormat {
+		t.Fatalf("Expected a format %v header, got %v", CaptureFormat, hr)
+	}
+
 	m := map[string]string{}
 	err = d.Decode(&m)
 	if m["a"] != "ayyy" {
@@ -145,3 +158,425 @@ func verify(t *testing.T, obname, filename string) {
 func TestZipFileStorerReader(t *testing.T) {
 	verifyStorerReader(t, "testingfile.zip")
 }
+
+func TestStreamStorerReader(t *testing.T) {
+	for _, pretty := range []bool{false, true} {
+		buf := &bytes.Buffer{}
+		s := newStreamStorer(buf, pretty)
+		for i := 0; i < 2; i++ {
+			something := map[string]interface{}{"a": "ayyy"}
+			_, _, err := s.Insert(NewItem(something,
+				basetime.Add(time.Duration(i)*time.Second)))
+			if err != nil {
+				t.Fatalf("Error storing item: %v", err)
+			}
+		}
+		s.Close()
+
+		if lines := bytes.Count(buf.Bytes(), []byte{'\n'}); !pretty && lines != 2 {
+			t.Fatalf("Expected two lines, got %v:\n%s", lines, buf)
+		}
+
+		r := newStreamReader(buf)
+		for i := 0; i < 2; i++ {
+			it, err := r.Next()
+			if err != nil {
+				t.Fatalf("Error reading item %v (pretty=%v): %v",
+					i, pretty, err)
+			}
+			exp := basetime.Add(time.Duration(i) * time.Second)
+			if !it.Timestamp().Equal(exp) {
+				t.Fatalf("Expected ts %v, got %v", exp, it.Timestamp())
+			}
+		}
+		if _, err := r.Next(); err != io.EOF {
+			t.Fatalf("Expected EOF, got: %v", err)
+		}
+	}
+}
+
+type memStorer struct {
+	items []StoredItem
+}
+
+func (m *memStorer) Insert(it StoredItem) (string, string, error) {
+	m.items = append(m.items, it)
+	return "", "", nil
+}
+
+func (m *memStorer) Close() error {
+	return nil
+}
+
+func TestRegisteredSchemes(t *testing.T) {
+	defer os.Remove("testingschemefile.gz")
+	verify(t, initData(t, "file:testingschemefile.gz"),
+		"file:testingschemefile.gz")
+	defer os.Remove("testingschemefile.zip")
+	verify(t, initData(t, "zip:testingschemefile.zip"),
+		"zip:testingschemefile.zip")
+
+	// A zip: URL makes a zip file regardless of the name.
+	defer os.Remove("testingscheme.cap")
+	initData(t, "zip:testingscheme.cap")
+	if _, err := zip.OpenReader("testingscheme.cap"); err != nil {
+		t.Fatalf("Expected a zip file: %v", err)
+	}
+
+	if _, err := GetStoreReader("stdout:"); err == nil {
+		t.Fatalf("Expected an error reading from stdout")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	var opened *url.URL
+	mem := &memStorer{}
+	Register("mem", func(u *url.URL) (Storer, error) {
+		opened = u
+		return mem, nil
+	}, nil)
+
+	fs, err := GetStorer("mem://somewhere/things?size=3")
+	if err != nil {
+		t.Fatalf("Error opening registered storer: %v", err)
+	}
+	fs.Insert(NewItem(map[string]interface{}{"a": "ayyy"}, basetime))
+	if len(mem.items) != 1 || opened.Query().Get("size") != "3" {
+		t.Fatalf("Didn't get the registered storer: %v %v", mem.items, opened)
+	}
+
+	if _, err := GetStoreReader("mem://somewhere/things"); err == nil {
+		t.Fatalf("Expected an error reading a write-only scheme")
+	}
+}
+
+func TestRefuseOverwrite(t *testing.T) {
+	for _, filename := range []string{"testexisting.gz", "testexisting.zip"} {
+		defer os.Remove(filename)
+		initData(t, filename)
+
+		if _, err := GetStorer(filename); err == nil {
+			t.Fatalf("Expected an error opening existing %v", filename)
+		}
+
+		fs, err := GetStorerMode(filename, Overwrite)
+		if err != nil {
+			t.Fatalf("Error overwriting %v: %v", filename, err)
+		}
+		fs.Close()
+		if n := countItems(t, filename); n != 0 {
+			t.Fatalf("Expected %v to be empty, found %v items", filename, n)
+		}
+	}
+
+	if _, err := GetStorerMode("testexisting.zip", Append); err == nil {
+		t.Fatalf("Expected an error appending to a zip file")
+	}
+}
+
+func TestAppendFileStorer(t *testing.T) {
+	filename := "testappend.gz"
+	defer os.Remove(filename)
+
+	for i := 0; i < 3; i++ {
+		url := "file:" + filename + "?mode=append"
+		if i == 0 {
+			url = filename
+		}
+		fs, err := GetStorer(url)
+		if err != nil {
+			t.Fatalf("Error opening %v: %v", url, err)
+		}
+		_, _, err = fs.Insert(NewItem(map[string]interface{}{"i": i},
+			basetime.Add(time.Duration(i)*time.Second)))
+		if err != nil {
+			t.Fatalf("Error storing item: %v", err)
+		}
+		fs.Close()
+	}
+
+	r, err := GetStoreReader(filename)
+	if err != nil {
+		t.Fatalf("Error opening reader: %v", err)
+	}
+	defer r.Close()
+	for i := 0; i < 3; i++ {
+		it, err := r.Next()
+		if err != nil {
+			t.Fatalf("Error reading item %v: %v", i, err)
+		}
+		if !it.Timestamp().Equal(basetime.Add(time.Duration(i) * time.Second)) {
+			t.Fatalf("Wrong item %v: %v", i, it.Timestamp())
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+}
+
+// Read everything up to an expected truncation.
+func expectTruncated(t *testing.T, filename string, n int) {
+	r, err := GetStoreReader(filename)
+	if err != nil {
+		t.Fatalf("Error opening %v: %v", filename, err)
+	}
+	defer r.Close()
+	for i := 0; i < n; i++ {
+		expectNext(t, r, i)
+	}
+	if _, err := r.Next(); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("Expected truncation after %v items, got %v", n, err)
+	}
+}
+
+func TestFlushRecords(t *testing.T) {
+	filename := "testflush.gz"
+	defer os.Remove(filename)
+
+	fs, err := GetStorer("file:" + filename + "?flush=0&flushrecords=2&fsync=true")
+	if err != nil {
+		t.Fatalf("Error opening storer: %v", err)
+	}
+	defer fs.Close()
+	for i := 0; i < 5; i++ {
+		_, _, err := fs.Insert(NewItem(map[string]interface{}{"i": i},
+			itemTime(i)))
+		if err != nil {
+			t.Fatalf("Error storing item: %v", err)
+		}
+	}
+
+	// The fifth is still waiting for a sixth.
+	expectTruncated(t, filename, 4)
+}
+
+func TestFlushInterval(t *testing.T) {
+	filename := "testflushtime.gz"
+	defer os.Remove(filename)
+
+	fs, err := GetStorer("file:" + filename + "?flush=10ms")
+	if err != nil {
+		t.Fatalf("Error opening storer: %v", err)
+	}
+	defer fs.Close()
+	fs.Insert(NewItem(map[string]interface{}{"i": 0}, itemTime(0)))
+
+	// The flush finishes a gzip member, so the record can be read
+	// without anything after it being missing.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if r, err := GetStoreReader(filename); err == nil {
+			_, err0 := r.Next()
+			_, err1 := r.Next()
+			r.Close()
+			if err0 == nil && err1 == io.EOF {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Capture was never flushed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTruncatedFile(t *testing.T) {
+	filename := "testtruncated.gz"
+	defer os.Remove(filename)
+
+	fs, err := GetStorer("file:" + filename + "?flushrecords=1")
+	if err != nil {
+		t.Fatalf("Error opening storer: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		fs.Insert(NewItem(map[string]interface{}{"i": i}, itemTime(i)))
+	}
+	st, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("Error checking %v: %v", filename, err)
+	}
+	flushed := st.Size()
+	fs.Insert(NewItem(map[string]interface{}{"i": 3}, itemTime(3)))
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+
+	// Cut part way into the last record.
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Error reading %v: %v", filename, err)
+	}
+	if err := os.WriteFile(filename, data[:flushed+3], 0666); err != nil {
+		t.Fatalf("Error truncating %v: %v", filename, err)
+	}
+	expectTruncated(t, filename, 3)
+
+	r, err := GetStoreReader(filename)
+	if err != nil {
+		t.Fatalf("Error opening %v: %v", filename, err)
+	}
+	defer r.Close()
+	if n, err := r.(SeekableReader).Len(); err != nil || n != 3 {
+		t.Fatalf("Expected 3 complete items indexed, got %v/%v", n, err)
+	}
+}
+
+// Leave behind what a killed statcap would: the first items flushed,
+// and the next one written, but not the end of the file.
+func writeCrashed(t *testing.T, url, filename string) {
+	writeItems(t, url, 0, 1, 2, 3)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Error reading %v: %v", filename, err)
+	}
+	if err := os.WriteFile(filename, data[:len(data)-4], 0666); err != nil {
+		t.Fatalf("Error truncating %v: %v", filename, err)
+	}
+}
+
+func TestAppendAfterCrash(t *testing.T) {
+	filename := "testappendcrash.gz"
+	defer os.Remove(filename)
+
+	writeCrashed(t, "file:"+filename+"?flushrecords=3", filename)
+	expectTruncated(t, filename, 4)
+	// The last record was all there, and is kept.
+	writeItems(t, "file:"+filename+"?mode=append", 4, 5)
+
+	r, err := GetStoreReader(filename)
+	if err != nil {
+		t.Fatalf("Error opening %v: %v", filename, err)
+	}
+	defer r.Close()
+	for i := 0; i < 6; i++ {
+		expectNext(t, r, i)
+	}
+	expectNext(t, r, -1)
+}
+
+func TestParseTimestamp(t *testing.T) {
+	ms := basetime.Add(250 * time.Millisecond)
+	tests := []struct {
+		in  interface{}
+		exp time.Time
+	}{
+		{basetime, basetime},
+		{basetime.Format(time.RFC3339), basetime},
+		{ms.Format(time.RFC3339Nano), ms},
+		{basetime.UTC().Format("2006-01-02T15:04:05"), basetime},
+		{float64(basetimeSecs), basetime},
+		{float64(basetimeSecs) + 0.25, ms},
+		{float64(basetimeSecs * 1000), basetime},
+		{float64(basetimeSecs*1000 + 250), ms},
+		{json.Number("1339646554250"), ms},
+		{"1339646554", basetime},
+		{int64(basetimeSecs), basetime},
+	}
+	for _, test := range tests {
+		got, err := ParseTimestamp(test.in)
+		if err != nil {
+			t.Errorf("Error parsing %v: %v", test.in, err)
+			continue
+		}
+		if !got.Equal(test.exp) {
+			t.Errorf("Parsing %v: expected %v, got %v", test.in, test.exp, got)
+		}
+	}
+
+	for _, in := range []interface{}{nil, "yesterday", true,
+		map[string]interface{}{}} {
+		if got, err := ParseTimestamp(in); err == nil {
+			t.Errorf("Expected an error parsing %v, got %v", in, got)
+		}
+	}
+}
+
+func TestTimestampE(t *testing.T) {
+	raw := func(s string) StoredItem {
+		rm := json.RawMessage(s)
+		return StoredItem{rawJ: &rm}
+	}
+	good := []StoredItem{
+		raw(`{"ts": 1339646554}`),
+		raw(`{"ts": 1339646554000}`),
+		raw(`{"ts": "2012-06-14T04:02:34Z"}`),
+		NewItem(map[string]interface{}{}, basetime),
+	}
+	for _, it := range good {
+		ts, err := it.TimestampE()
+		if err != nil || !ts.Equal(basetime) {
+			t.Errorf("Expected %v from %+v, got %v/%v", basetime, it, ts, err)
+		}
+	}
+
+	bad := []StoredItem{
+		raw(`{"a": 1}`),
+		raw(`{"ts": "whenever"}`),
+		raw(`{"ts": `),
+		raw(`[1, 2]`),
+		{},
+	}
+	for _, it := range bad {
+		if ts, err := it.TimestampE(); err == nil {
+			t.Errorf("Expected an error from %+v, got %v", it, ts)
+		}
+	}
+
+	if _, err := (StoredItem{}).MarshalJSON(); err == nil {
+		t.Errorf("Expected an error marshaling an empty item")
+	}
+}
+
+// Items read from one capture can be written to another, and bad ones
+// are refused rather than crashing anything.
+func TestCopyReadItems(t *testing.T) {
+	src, dst := "testcopy-src.gz", "testcopy-dst.gz"
+	defer os.Remove(src)
+	defer os.Remove(dst)
+
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatalf("Error creating %v: %v", src, err)
+	}
+	z := gzip.NewWriter(f)
+	z.Write([]byte(`{"i": 0, "ts": 1339646554}` + "\n" +
+		`{"i": 1, "ts": "not a time"}` + "\n" +
+		`{"i": 2, "ts": "2012-06-14T04:02:36Z"}` + "\n"))
+	z.Close()
+	f.Close()
+
+	r, err := GetStoreReader(src)
+	if err != nil {
+		t.Fatalf("Error opening %v: %v", src, err)
+	}
+	defer r.Close()
+	w, err := GetStorer(dst)
+	if err != nil {
+		t.Fatalf("Error opening %v: %v", dst, err)
+	}
+	errs := 0
+	for {
+		it, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+		if _, _, err := w.Insert(it); err != nil {
+			errs++
+		}
+	}
+	w.Close()
+	if errs != 1 {
+		t.Fatalf("Expected one bad item, got %v", errs)
+	}
+
+	if got := readItems(t, dst); !reflect.DeepEqual(got, []int{0, 2}) {
+		t.Fatalf("Expected items 0 and 2, got %v", got)
+	}
+	r2, _ := GetStoreReader(dst)
+	defer r2.Close()
+	expectNext(t, r2, 0)
+	expectNext(t, r2, 2)
+}
@@ -2,6 +2,11 @@ package statstore
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -10,6 +15,9 @@ type StoredItem struct {
 	ts   *time.Time
 	rawJ *json.RawMessage
 	rawI *interface{}
+
+	// The item as generic JSON, decoded the first time it's needed.
+	decoded *decodedItem
 }
 
 func (s StoredItem) MarshalJSON() (rv []byte, err error) {
@@ -19,7 +27,7 @@ func (s StoredItem) MarshalJSON() (rv []byte, err error) {
 	case s.rawI != nil:
 		rv, err = json.Marshal(s.rawI)
 	default:
-		panic("invalid item")
+		err = errEmptyItem
 	}
 	return
 }
@@ -29,19 +37,78 @@ func (s *StoredItem) UnmarshalJSON(in []byte) error {
 	copy(d, in)
 	rm := json.RawMessage(d)
 	s.rawJ = &rm
+	s.decoded = nil
 	return nil
 }
 
-func (s *StoredItem) extractRawTS() time.Time {
+var errEmptyItem = errors.New("statstore: empty item")
+
+var errNoTimestamp = errors.New("statstore: item has no timestamp")
+
+// Anything past this as an epoch time is taken as milliseconds.
+// (As seconds, it's the year 5138.)
+const epochMillisCutoff = 1e11
+
+func epochTime(f float64) time.Time {
+	if math.Abs(f) >= epochMillisCutoff {
+		ms := math.Floor(f)
+		return time.Unix(0, int64(ms)*int64(time.Millisecond)+
+			int64((f-ms)*float64(time.Millisecond)))
+	}
+	secs := math.Floor(f)
+	return time.Unix(int64(secs), int64((f-secs)*float64(time.Second)))
+}
+
+// Parse a timestamp the way captures have stored them over the
+// years: RFC 3339 strings (a string without a zone is taken as UTC),
+// or epoch seconds or milliseconds as numbers or numeric strings.
+func ParseTimestamp(v interface{}) (time.Time, error) {
+	switch x := v.(type) {
+	case time.Time:
+		return x, nil
+	case *time.Time:
+		if x != nil {
+			return *x, nil
+		}
+	case string:
+		if ts, err := time.Parse(time.RFC3339Nano, x); err == nil {
+			return ts, nil
+		}
+		if ts, err := time.Parse("2006-01-02T15:04:05.999999999", x); err == nil {
+			return ts, nil
+		}
+		if f, err := strconv.ParseFloat(x, 64); err == nil {
+			return epochTime(f), nil
+		}
+		return time.Time{}, fmt.Errorf("statstore: invalid timestamp %q", x)
+	case float64:
+		return epochTime(x), nil
+	case json.Number:
+		f, err := x.Float64()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("statstore: invalid timestamp %q", x)
+		}
+		return epochTime(f), nil
+	case int:
+		return epochTime(float64(x)), nil
+	case int64:
+		return epochTime(float64(x)), nil
+	case nil:
+		return time.Time{}, errNoTimestamp
+	}
+	return time.Time{}, fmt.Errorf("statstore: invalid timestamp %v (%T)", v, v)
+}
+
+func (s *StoredItem) extractRawTS() (time.Time, error) {
 	out := struct {
-		TS time.Time
+		TS interface{}
 	}{}
 	err := json.Unmarshal([]byte(*s.rawJ), &out)
 	if err != nil {
-		panic("Error reading timestamp from raw JSON: " + err.Error())
+		return time.Time{}, fmt.Errorf("statstore: error reading "+
+			"timestamp from raw JSON: %v", err)
 	}
-	s.ts = &out.TS
-	return out.TS
+	return ParseTimestamp(out.TS)
 }
 
 func NewItem(data interface{}, ts time.Time) (rv StoredItem) {
@@ -50,40 +117,79 @@ func NewItem(data interface{}, ts time.Time) (rv StoredItem) {
 	return
 }
 
-func (s *StoredItem) extractITS() time.Time {
-	if m, ok := (*s.rawI).(map[string]interface{}); ok {
-		switch i := m["ts"].(type) {
-		case time.Time:
-			s.ts = &i
-			return *s.ts
-		case string:
-			ts, err := time.Parse(time.RFC3339Nano, i)
-			if err != nil {
-				panic("Error parsing time: " + err.Error())
-			}
-			s.ts = &ts
-			return *s.ts
-		}
+func (s *StoredItem) extractITS() (time.Time, error) {
+	m, ok := (*s.rawI).(map[string]interface{})
+	if !ok {
+		return time.Time{}, errNoTimestamp
 	}
-	panic("Couldn't extract timestamp from interface{}")
+	return ParseTimestamp(m["ts"])
 }
 
 func (s *StoredItem) UnmarshalInto(i interface{}) error {
 	return json.Unmarshal([]byte(*s.rawJ), i)
 }
 
-func (s *StoredItem) Timestamp() (ts time.Time) {
+// The item's timestamp, or an error if it doesn't have a usable one.
+func (s *StoredItem) TimestampE() (time.Time, error) {
+	if s.ts != nil {
+		return *s.ts, nil
+	}
+	var ts time.Time
+	var err error
 	switch {
-	case s.ts != nil:
-		ts = *s.ts
 	case s.rawJ != nil:
-		ts = s.extractRawTS()
+		ts, err = s.extractRawTS()
 	case s.rawI != nil:
-		ts = s.extractITS()
+		ts, err = s.extractITS()
 	default:
-		panic("No data found for extracting timestamp.")
+		err = errEmptyItem
 	}
-	return
+	if err == nil {
+		s.ts = &ts
+	}
+	return ts, err
+}
+
+// The item's timestamp.  This panics if there isn't a usable one, so
+// anything reading data it didn't make itself should use TimestampE.
+func (s *StoredItem) Timestamp() time.Time {
+	ts, err := s.TimestampE()
+	if err != nil {
+		panic(err)
+	}
+	return ts
+}
+
+// The item's JSON, with its timestamp added if the document doesn't
+// carry it.
+func (s *StoredItem) jsonWithTS() ([]byte, error) {
+	ts, err := s.TimestampE()
+	if err != nil {
+		return nil, err
+	}
+	if s.rawI != nil {
+		if m, ok := (*s.rawI).(map[string]interface{}); ok {
+			if _, ok := m["ts"]; !ok {
+				m["ts"] = ts
+			}
+			return json.Marshal(m)
+		}
+	}
+	b, err := s.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	if _, ok := fields["ts"]; ok {
+		return b, nil
+	}
+	if fields["ts"], err = json.Marshal(ts); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
 }
 
 // Interface for things that store things.
@@ -95,24 +201,162 @@ type Storer interface {
 // Interface for reading stored things.
 type Reader interface {
 	Next() (StoredItem, error)
+	// The header of the capture being read, or nil if it doesn't
+	// have one (e.g. it was written before there were headers, or
+	// isn't a file).
+	Header() (*Header, error)
 	Close() error
 }
 
+// Readers that can jump to a time rather than reading everything.
+// Items are assumed to be in time order.
+type SeekableReader interface {
+	Reader
+	// The number of items.  Finding out may mean reading all of
+	// them.
+	Len() (int, error)
+	// Position the reader so Next returns the first item at or
+	// after t.
+	Seek(t time.Time) error
+	// A reader of just the items from from (inclusive) to to
+	// (exclusive).
+	Range(from, to time.Time) (Reader, error)
+}
+
+// How to treat an existing file when opening a file or zip storer.
+type Mode int
+
+const (
+	// Refuse to touch an existing file.
+	CreateNew = Mode(iota)
+	// Add to an existing gzip capture as a new gzip member.
+	Append
+	// Replace an existing file.
+	Overwrite
+)
+
+var modeNames = []string{"create", "append", "overwrite"}
+
+func (m Mode) String() string {
+	return modeNames[m]
+}
+
+func parseMode(s string) (Mode, error) {
+	if s == "" {
+		return CreateNew, nil
+	}
+	for i, n := range modeNames {
+		if s == n {
+			return Mode(i), nil
+		}
+	}
+	return CreateNew, fmt.Errorf("invalid mode: %q", s)
+}
+
+// Open a file according to a mode.
+func openForMode(path string, mode Mode) (*os.File, error) {
+	flags := os.O_WRONLY | os.O_CREATE
+	switch mode {
+	case CreateNew:
+		flags |= os.O_EXCL
+	case Append:
+		flags |= os.O_APPEND
+	case Overwrite:
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0666)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("%v already exists "+
+			"(append to it or force overwriting it)", path)
+	}
+	return f, err
+}
+
 // Get a storer for the given path.
+//
+// Paths beginning with a registered scheme (file:, zip:, stdout:,
+// couch+http:, or anything added with Register) go to that backend.
+// Otherwise "-" writes JSON lines to stdout, http:// and https://
+// URLs go to CouchDB, .zip files are zip captures and anything else
+// is a gzip capture.
+//
+// Existing files are never overwritten; see GetStorerMode.
 func GetStorer(path string) (Storer, error) {
-	if strings.HasPrefix(path, "http://") {
+	return GetStorerMode(path, CreateNew)
+}
+
+// Get a storer for the given path, saying what to do if it's an
+// existing file.  A mode= query parameter on a file: or zip: URL
+// overrides the mode given here.
+//
+// New files start with a header from NewHeader.
+func GetStorerMode(path string, mode Mode) (Storer, error) {
+	return GetStorerHeader(path, mode, NewHeader())
+}
+
+// Get a storer as GetStorerMode does, starting new files with the
+// given header.
+func GetStorerHeader(path string, mode Mode, h Header) (Storer, error) {
+	s, err := openStorer(path, mode)
+	if err != nil {
+		return nil, err
+	}
+	if hw, ok := s.(headerWriter); ok {
+		if err := hw.writeHeader(h); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func openStorer(path string, mode Mode) (Storer, error) {
+	if u, b, ok := lookupBackend(path); ok {
+		q := u.Query()
+		if q.Get("mode") == "" && mode != CreateNew {
+			q.Set("mode", mode.String())
+			u.RawQuery = q.Encode()
+		}
+		return openRegisteredStorer(u, b)
+	}
+	if path == "-" {
+		return newStreamStorer(os.Stdout, false), nil
+	}
+	if strings.HasPrefix(path, "http://") ||
+		strings.HasPrefix(path, "https://") {
 		return openCouchStorer(path)
 	}
 	if strings.HasSuffix(path, ".zip") {
-		return openZipStorer(path)
+		return openZipStorer(path, mode)
 	}
-	return openFileStorer(path)
+	return openFileStorer(path, mode, defaultFileOptions)
 }
 
 // Get a storer reader for the given path.
+//
+// As with GetStorer, registered schemes come first.  Otherwise "-"
+// reads JSON lines from stdin, http:// and https:// URLs are read
+// from CouchDB in timestamp order, a glob (that isn't itself a file
+// name) merges all the captures it matches in timestamp order, .zip
+// files are zip captures and anything else is a gzip capture.
 func GetStoreReader(path string) (Reader, error) {
+	if u, b, ok := lookupBackend(path); ok {
+		return openRegisteredReader(u, b)
+	}
+	if path == "-" {
+		return openStdinReader()
+	}
+	if strings.HasPrefix(path, "http://") ||
+		strings.HasPrefix(path, "https://") {
+		return openCouchReader(path)
+	}
+	if isGlob(path) {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return OpenMergeReader(path, false)
+		}
+	}
 	if strings.HasSuffix(path, ".zip") {
 		return openZipReader(path)
 	}
-	return openFileReader(path)
+	return openFileReader(path, nil)
 }
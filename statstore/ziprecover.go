@@ -0,0 +1,189 @@
+package statstore
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+const (
+	zipLocalHeaderSig   = 0x04034b50
+	zipCentralHeaderSig = 0x02014b50
+	zipDescriptorSig    = 0x08074b50
+
+	zipLocalHeaderLen = 30
+	// Sizes are in a data descriptor after the data.
+	zipFlagDescriptor = 0x8
+)
+
+// Reads a stream a byte at a time as far as flate is concerned, so
+// it never reads past the end of a compressed entry, and keeps track
+// of where it is.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+var errZipTruncated = errors.New("truncated zip entry")
+
+// Read the data descriptor that follows a streamed entry.  The
+// signature is optional, and sizes may be 32 or 64 bits.
+func readDescriptor(r *countingReader, comp, size int64) (uint32, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, errZipTruncated
+	}
+	if binary.LittleEndian.Uint32(b) == zipDescriptorSig {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, errZipTruncated
+		}
+	}
+	crc := binary.LittleEndian.Uint32(b)
+
+	sizes := make([]byte, 8)
+	if _, err := io.ReadFull(r, sizes); err != nil {
+		return 0, errZipTruncated
+	}
+	if int64(binary.LittleEndian.Uint32(sizes)) == comp &&
+		int64(binary.LittleEndian.Uint32(sizes[4:])) == size {
+		return crc, nil
+	}
+	more := make([]byte, 8)
+	if _, err := io.ReadFull(r, more); err != nil {
+		return 0, errZipTruncated
+	}
+	sizes = append(sizes, more...)
+	if int64(binary.LittleEndian.Uint64(sizes)) != comp ||
+		int64(binary.LittleEndian.Uint64(sizes[8:])) != size {
+		return 0, fmt.Errorf("zip data descriptor doesn't match entry")
+	}
+	return crc, nil
+}
+
+// Decompress an entry's data to check it, returning its compressed
+// size.
+func checkEntry(r *countingReader, hdr *zip.FileHeader, streamed bool) (int64, error) {
+	start := r.n
+	var src io.Reader = r
+	if !streamed {
+		src = io.LimitReader(r, int64(hdr.CompressedSize64))
+	}
+	switch hdr.Method {
+	case zip.Deflate:
+		src = flate.NewReader(src)
+	case zip.Store:
+		if streamed {
+			return 0, fmt.Errorf("can't find the end of stored entry %v",
+				hdr.Name)
+		}
+	default:
+		return 0, zip.ErrAlgorithm
+	}
+
+	h := crc32.NewIEEE()
+	n, err := io.Copy(h, src)
+	if err == io.ErrUnexpectedEOF {
+		return 0, errZipTruncated
+	} else if err != nil {
+		return 0, err
+	}
+	comp := r.n - start
+
+	crc := hdr.CRC32
+	if streamed {
+		crc, err = readDescriptor(r, comp, n)
+		if err != nil {
+			return 0, err
+		}
+		hdr.CRC32 = crc
+		hdr.CompressedSize64 = uint64(comp)
+		hdr.UncompressedSize64 = uint64(n)
+	} else if comp != int64(hdr.CompressedSize64) ||
+		n != int64(hdr.UncompressedSize64) {
+		return 0, errZipTruncated
+	}
+	if h.Sum32() != crc {
+		return 0, zip.ErrChecksum
+	}
+	return comp, nil
+}
+
+// Find the entries of a zip file by walking its local file headers,
+// for when there's no central directory to read.  Every complete
+// entry up to the first broken one is returned, along with what
+// stopped the scan (nil if it reached the end cleanly).
+func scanZip(f *os.File) ([]zipEntry, error) {
+	r := &countingReader{r: bufio.NewReader(f)}
+	rv := []zipEntry{}
+
+	for {
+		b := make([]byte, zipLocalHeaderLen)
+		n, err := io.ReadFull(r, b)
+		if n == 0 && err == io.EOF {
+			return rv, nil
+		}
+		if err != nil {
+			return rv, errZipTruncated
+		}
+		switch binary.LittleEndian.Uint32(b) {
+		case zipLocalHeaderSig:
+		case zipCentralHeaderSig:
+			return rv, nil
+		default:
+			return rv, fmt.Errorf("no zip entry at offset %v", r.n-int64(n))
+		}
+
+		flags := binary.LittleEndian.Uint16(b[6:8])
+		hdr := &zip.FileHeader{
+			Flags:              flags,
+			Method:             binary.LittleEndian.Uint16(b[8:10]),
+			CRC32:              binary.LittleEndian.Uint32(b[14:18]),
+			CompressedSize64:   uint64(binary.LittleEndian.Uint32(b[18:22])),
+			UncompressedSize64: uint64(binary.LittleEndian.Uint32(b[22:26])),
+		}
+		name := make([]byte, binary.LittleEndian.Uint16(b[26:28]))
+		hdr.Extra = make([]byte, binary.LittleEndian.Uint16(b[28:30]))
+		if _, err := io.ReadFull(r, name); err != nil {
+			return rv, errZipTruncated
+		}
+		if _, err := io.ReadFull(r, hdr.Extra); err != nil {
+			return rv, errZipTruncated
+		}
+		hdr.Name = string(name)
+
+		offset := r.n
+		comp, err := checkEntry(r, hdr, flags&zipFlagDescriptor != 0)
+		if err != nil {
+			return rv, fmt.Errorf("%v at offset %v: %w", hdr.Name, offset, err)
+		}
+
+		method := hdr.Method
+		rv = append(rv, newZipEntry(hdr, func() (io.ReadCloser, error) {
+			data := io.NewSectionReader(f, offset, comp)
+			if method == zip.Deflate {
+				return flate.NewReader(data), nil
+			}
+			return io.NopCloser(data), nil
+		}))
+	}
+}
@@ -0,0 +1,105 @@
+package statstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestRecoverUnclosedZip(t *testing.T) {
+	filename := "testunclosed.zip"
+	defer os.Remove(filename)
+
+	fs, err := GetStorer(filename)
+	if err != nil {
+		t.Fatalf("Error opening storer: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		_, _, err := fs.Insert(NewItem(map[string]interface{}{"i": i},
+			itemTime(i)))
+		if err != nil {
+			t.Fatalf("Error storing item: %v", err)
+		}
+	}
+	// Never closed, as if the process was killed.
+	defer fs.Close()
+
+	r, err := GetStoreReader(filename)
+	if err != nil {
+		t.Fatalf("Error opening unclosed zip: %v", err)
+	}
+	for _, i := range []int{0, 1, 2, 3, 4, -1} {
+		expectNext(t, r, i)
+	}
+	r.Close()
+
+	// Lose the end of the last entry too.
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Error reading zip: %v", err)
+	}
+	if err := os.WriteFile(filename, data[:len(data)-5], 0666); err != nil {
+		t.Fatalf("Error truncating zip: %v", err)
+	}
+	r, err = GetStoreReader(filename)
+	if err != nil {
+		t.Fatalf("Error opening truncated zip: %v", err)
+	}
+	for _, i := range []int{0, 1, 2, 3} {
+		expectNext(t, r, i)
+	}
+	if _, err := r.Next(); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("Expected truncation after the last entry, got %v", err)
+	}
+	expectNext(t, r, -1)
+	r.Close()
+}
+
+func TestRecoverStreamedZip(t *testing.T) {
+	filename := "teststreamed.zip"
+	defer os.Remove(filename)
+
+	// Entries written the old way, with a data descriptor after each.
+	writeRawZip(t, filename, []rawZipEntry{
+		{0, itemTime(0).Local().Format(timeFormat), ""},
+		{1, itemTime(1).Local().Format(timeFormat), ""},
+		{2, itemTime(2).Local().Format(timeFormat), ""},
+	})
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Error reading zip: %v", err)
+	}
+	sig := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sig, zipCentralHeaderSig)
+	i := bytes.Index(data, sig)
+	if i < 0 {
+		t.Fatalf("No central directory in %v", filename)
+	}
+	if err := os.WriteFile(filename, data[:i], 0666); err != nil {
+		t.Fatalf("Error truncating zip: %v", err)
+	}
+
+	r, err := GetStoreReader(filename)
+	if err != nil {
+		t.Fatalf("Error opening zip without a directory: %v", err)
+	}
+	defer r.Close()
+	for _, i := range []int{0, 1, 2, -1} {
+		expectNext(t, r, i)
+	}
+}
+
+func TestRecoverNotZip(t *testing.T) {
+	filename := "testnotzip.zip"
+	defer os.Remove(filename)
+
+	if err := os.WriteFile(filename, []byte("hello, world"), 0666); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	if _, err := GetStoreReader(filename); err == nil {
+		t.Fatalf("Expected an error reading a non-zip")
+	}
+}
@@ -2,9 +2,15 @@ package statstore
 
 import (
 	"archive/zip"
+	"bytes"
+	"compress/flate"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"log"
 	"os"
 	"sort"
 	"sync"
@@ -19,13 +25,21 @@ type zipStorer struct {
 	lock sync.Mutex
 	file *os.File
 	z    *zip.Writer
+
+	// Entries are compressed here first so each one is complete in
+	// the file (sizes and all) as soon as it's inserted.
+	buf bytes.Buffer
+	fw  *flate.Writer
 }
 
 func (z *zipStorer) Insert(ob StoredItem) (string, string, error) {
 	z.lock.Lock()
 	defer z.lock.Unlock()
 
-	ts := ob.Timestamp()
+	ts, err := ob.TimestampE()
+	if err != nil {
+		return "", "", err
+	}
 	filename := ts.Format(timeFormat)
 
 	tagts := []byte(ts.Format(time.RFC3339Nano))
@@ -34,23 +48,66 @@ func (z *zipStorer) Insert(ob StoredItem) (string, string, error) {
 	binary.LittleEndian.PutUint16(tag[0:2], timeTag)
 	binary.LittleEndian.PutUint16(tag[2:4], uint16(len(tagts)))
 
+	body, err := json.Marshal(ob)
+	if err != nil {
+		return "", "", err
+	}
+
 	h := zip.FileHeader{
-		Name:   filename,
-		Method: zip.Deflate,
-		Extra:  append(tag, tagts...),
+		Name:  filename,
+		Extra: append(tag, tagts...),
 	}
 	h.SetModTime(ts)
+	return filename, "", z.writeEntry(&h, append(body, '\n'))
+}
 
-	f, err := z.z.CreateHeader(&h)
+// Write a complete entry and flush it to the file.
+func (z *zipStorer) writeEntry(h *zip.FileHeader, body []byte) error {
+	z.buf.Reset()
+	z.fw.Reset(&z.buf)
+	z.fw.Write(body)
+	if err := z.fw.Close(); err != nil {
+		return err
+	}
+
+	h.Method = zip.Deflate
+	h.CRC32 = crc32.ChecksumIEEE(body)
+	h.CompressedSize64 = uint64(z.buf.Len())
+	h.UncompressedSize64 = uint64(len(body))
+
+	f, err := z.z.CreateRaw(h)
 	if err != nil {
-		return "", "", err
+		return err
 	}
-	err = json.NewEncoder(f).Encode(ob)
+	if _, err := f.Write(z.buf.Bytes()); err != nil {
+		return err
+	}
+
+	// Only Close writes the central directory, but with the entry on
+	// disk a reader can recover it if we never get there.
+	return z.z.Flush()
+}
+
+// Zip captures are always new, so the manifest goes first.
+func (z *zipStorer) writeHeader(hd Header) error {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+
+	body, err := json.Marshal(hd)
 	if err != nil {
-		return "", "", err
+		return err
 	}
+	h := zip.FileHeader{Name: manifestName}
+	h.SetModTime(hd.Created)
+	return z.writeEntry(&h, append(body, '\n'))
+}
 
-	return filename, "", nil
+func (z *zipStorer) size() (int64, error) {
+	st, err := z.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
 }
 
 func (z *zipStorer) Close() error {
@@ -60,47 +117,135 @@ func (z *zipStorer) Close() error {
 	return z.z.Close()
 }
 
-func openZipStorer(filepath string) (*zipStorer, error) {
-	f, err := os.Create(filepath)
+func openZipStorer(filepath string, mode Mode) (*zipStorer, error) {
+	if mode == Append {
+		return nil, fmt.Errorf("can't append to zip capture %v", filepath)
+	}
+	f, err := openForMode(filepath, mode)
 	if err != nil {
 		return nil, err
 	}
 	z := zip.NewWriter(f)
+	fw, err := flate.NewWriter(nil, flate.DefaultCompression)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 	return &zipStorer{
 		file: f,
 		z:    z,
+		fw:   fw,
 	}, nil
 }
 
-type fileList []*zip.File
+// A zip entry and when it was captured.
+type zipEntry struct {
+	hdr   *zip.FileHeader
+	open  func() (io.ReadCloser, error)
+	ts    time.Time
+	hasTS bool
+	// Whether ts came from the extra field rather than the name.
+	tagged bool
+}
+
+type ZipReader struct {
+	z io.Closer
+	// Range readers share their parent's zip file.
+	shared bool
+
+	entries []zipEntry
+	current int
+	// Why recovering an unfinished zip stopped early, reported after
+	// the last entry that could be recovered.
+	damage error
 
-func (f fileList) Len() int {
-	return len(f)
+	header    *Header
+	headerErr error
 }
 
-func (f fileList) Less(i, j int) bool {
-	return f[i].Comment < f[j].Comment
+func (z *ZipReader) Header() (*Header, error) {
+	return z.header, z.headerErr
 }
 
-func (f fileList) Swap(i, j int) {
-	f[j], f[i] = f[i], f[j]
+// Find the timestamp stored in a zip entry's extra field.
+func tagTime(extra []byte) (time.Time, bool, error) {
+	b := extra
+	for len(b) >= 4 {
+		tag := binary.LittleEndian.Uint16(b[:2])
+		size := int(binary.LittleEndian.Uint16(b[2:4]))
+		b = b[4:]
+		if size > len(b) {
+			break
+		}
+		if tag == timeTag {
+			ts, err := time.Parse(time.RFC3339, string(b[:size]))
+			return ts, err == nil, err
+		}
+		b = b[size:]
+	}
+	return time.Time{}, false, nil
 }
 
-type ZipReader struct {
-	z *zip.ReadCloser
+// An entry timed from its extra field or failing that, its name.
+// Names don't record a time zone, so they're taken as local time.
+func newZipEntry(hdr *zip.FileHeader,
+	open func() (io.ReadCloser, error)) zipEntry {
 
-	files   fileList
-	current int
+	if ts, ok, _ := tagTime(hdr.Extra); ok {
+		return zipEntry{hdr, open, ts, true, true}
+	}
+	ts, err := time.ParseInLocation(timeFormat, hdr.Name, time.Local)
+	return zipEntry{hdr, open, ts, err == nil, false}
+}
+
+// Put entries in chronological order.  Entries with the same time
+// stay in archive order, and those whose time can't be determined go
+// at the end (in archive order).  Exact copies of an entry (as
+// happens when archives are merged) are dropped.
+func sortEntries(entries []zipEntry) []zipEntry {
+	type key struct {
+		name string
+		ts   time.Time
+		crc  uint32
+		size uint64
+	}
+	seen := map[key]bool{}
+
+	rv := make([]zipEntry, 0, len(entries))
+	for _, e := range entries {
+		k := key{e.hdr.Name, e.ts.UTC(), e.hdr.CRC32, e.hdr.UncompressedSize64}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		rv = append(rv, e)
+	}
+
+	sort.SliceStable(rv, func(i, j int) bool {
+		a, b := rv[i], rv[j]
+		if a.hasTS != b.hasTS {
+			return a.hasTS
+		}
+		return a.hasTS && a.ts.Before(b.ts)
+	})
+	return rv
 }
 
 func (z *ZipReader) Close() error {
+	if z.shared {
+		return nil
+	}
 	return z.z.Close()
 }
 
 func (z *ZipReader) Next() (StoredItem, error) {
 	rv := StoredItem{}
 
-	if z.current >= len(z.files) {
+	if z.current >= len(z.entries) {
+		if err := z.damage; err != nil {
+			z.damage = nil
+			return rv, err
+		}
 		return rv, io.EOF
 	}
 
@@ -108,50 +253,118 @@ func (z *ZipReader) Next() (StoredItem, error) {
 		z.current++
 	}()
 
-	r, err := z.files[z.current].Open()
+	e := z.entries[z.current]
+	r, err := e.open()
 	if err != nil {
 		return rv, err
 	}
 	defer r.Close()
 
-	err = json.NewDecoder(r).Decode(&rv)
+	// Read it all so the checksum is checked.
+	b, err := io.ReadAll(r)
 	if err != nil {
-		return rv, err
+		return rv, fmt.Errorf("%v: %w", e.hdr.Name, err)
+	}
+	err = json.Unmarshal(b, &rv)
+	if err != nil {
+		return rv, fmt.Errorf("%v: %w", e.hdr.Name, err)
 	}
 
-	zf := z.files[z.current]
-	if len(zf.Extra) > 0 {
-		b := zf.Extra
-		for len(b) >= 4 {
-			tag := binary.LittleEndian.Uint16(b[:2])
-			b = b[2:]
-			size := binary.LittleEndian.Uint16(b[:2])
-			b = b[2:]
-			if tag == timeTag {
-				var ts time.Time
-				ts, err = time.Parse(time.RFC3339,
-					string(b[:size]))
-				rv.ts = &ts
-			}
-			b = b[size:]
-		}
+	// Names don't say what zone they're in, so without a tag the
+	// timestamp comes from the document itself if it has one.
+	if _, err := rv.TimestampE(); e.tagged || (e.hasTS && err != nil) {
+		ts := e.ts
+		rv.ts = &ts
 	}
 
-	return rv, err
+	return rv, nil
+}
+
+// The number of entries.
+func (z *ZipReader) Len() (int, error) {
+	return len(z.entries), nil
 }
 
+// The index of the first entry at or after t.  Entries without a
+// time sort after everything.
+func (z *ZipReader) search(t time.Time) int {
+	return sort.Search(len(z.entries), func(i int) bool {
+		e := z.entries[i]
+		return !e.hasTS || !e.ts.Before(t)
+	})
+}
+
+// Position the reader so Next returns the first entry at or after t.
+func (z *ZipReader) Seek(t time.Time) error {
+	z.current = z.search(t)
+	return nil
+}
+
+// A reader of the entries from from (inclusive) to to (exclusive).
+// It shares this reader's file, so it must be used before this
+// reader is closed.
+func (z *ZipReader) Range(from, to time.Time) (Reader, error) {
+	i, j := z.search(from), z.search(to)
+	if j < i {
+		j = i
+	}
+	return &ZipReader{
+		z:         z.z,
+		shared:    true,
+		entries:   z.entries[i:j],
+		header:    z.header,
+		headerErr: z.headerErr,
+	}, nil
+}
+
+// Open a zip capture.  One that was never closed (so has no central
+// directory) is recovered by scanning its entries.
 func openZipReader(filepath string) (*ZipReader, error) {
 	f, err := zip.OpenReader(filepath)
+	if err == zip.ErrFormat {
+		return recoverZipReader(filepath)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	files := make(fileList, len(f.File))
-	copy(files, f.File)
-	sort.Sort(files)
+	entries := make([]zipEntry, 0, len(f.File))
+	for _, zf := range f.File {
+		entries = append(entries, newZipEntry(&zf.FileHeader, zf.Open))
+	}
+	entries, h, herr := splitManifest(entries)
+	return &ZipReader{
+		z:         f,
+		entries:   sortEntries(entries),
+		header:    h,
+		headerErr: herr,
+	}, nil
+}
 
+func recoverZipReader(filepath string) (*ZipReader, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := scanZip(f)
+	if err != nil && len(entries) == 0 {
+		f.Close()
+		return nil, fmt.Errorf("%v: %v", filepath, err)
+	}
+	log.Printf("Recovered %v entries from unfinished %v",
+		len(entries), filepath)
+	if errors.Is(err, errZipTruncated) {
+		err = fmt.Errorf("%v: %w after %d complete entries",
+			filepath, ErrTruncated, len(entries))
+	} else if err != nil {
+		err = fmt.Errorf("%v: %w", filepath, err)
+	}
+	entries, h, herr := splitManifest(entries)
 	return &ZipReader{
-		z:     f,
-		files: files,
+		z:         f,
+		entries:   sortEntries(entries),
+		damage:    err,
+		header:    h,
+		headerErr: herr,
 	}, nil
 }
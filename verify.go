@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dustin/statcap/statstore"
+)
+
+// What's wrong (if anything) with one capture.
+type verifyReport struct {
+	Path    string        `json:"path"`
+	OK      bool          `json:"ok"`
+	Records int           `json:"records"`
+	First   *time.Time    `json:"first,omitempty"`
+	Last    *time.Time    `json:"last,omitempty"`
+	Errors  []verifyIssue `json:"errors,omitempty"`
+	// What the capture says about itself, if it says anything.
+	Header *statstore.Header `json:"header,omitempty"`
+	// Records earlier than the one before them.
+	OutOfOrder []verifyIssue `json:"out_of_order,omitempty"`
+	// Stretches longer than -maxgap without a record.
+	Gaps      []verifyIssue `json:"gaps,omitempty"`
+	Truncated bool          `json:"truncated,omitempty"`
+	// How many of each kind of issue there were (the lists stop at
+	// -max).
+	ErrorCount      int `json:"error_count"`
+	OutOfOrderCount int `json:"out_of_order_count"`
+	GapCount        int `json:"gap_count"`
+}
+
+type verifyIssue struct {
+	// Records successfully read before this one.
+	Record   int        `json:"record"`
+	Error    string     `json:"error,omitempty"`
+	TS       *time.Time `json:"ts,omitempty"`
+	Previous *time.Time `json:"previous,omitempty"`
+	Duration string     `json:"duration,omitempty"`
+}
+
+type verifyOptions struct {
+	maxGap time.Duration
+	// Most issues of each kind to list.
+	maxIssues int
+}
+
+func addIssue(list *[]verifyIssue, count *int, max int, issue verifyIssue) {
+	*count++
+	if len(*list) < max {
+		*list = append(*list, issue)
+	}
+}
+
+// Read a capture all the way through, checking each record as we go.
+// Readers check what they can as they read (gzip and zip checksums,
+// truncation), so their errors are reported as they happen.  A reader
+// that returns the same error twice running can't get past it, so
+// that's where checking stops.
+func verifyCapture(path string, opts verifyOptions) (rep verifyReport) {
+	rep.Path = path
+	defer func() {
+		rep.OK = rep.ErrorCount == 0 && rep.OutOfOrderCount == 0 &&
+			rep.GapCount == 0
+	}()
+
+	r, err := statstore.GetStoreReader(path)
+	if err != nil {
+		addIssue(&rep.Errors, &rep.ErrorCount, opts.maxIssues,
+			verifyIssue{Error: err.Error()})
+		return rep
+	}
+	defer r.Close()
+
+	rep.Header, err = r.Header()
+	if err != nil {
+		addIssue(&rep.Errors, &rep.ErrorCount, opts.maxIssues,
+			verifyIssue{Error: "header: " + err.Error()})
+	}
+
+	var prev *time.Time
+	lastErr := ""
+	for {
+		it, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if err.Error() == lastErr {
+				break
+			}
+			lastErr = err.Error()
+			if errors.Is(err, statstore.ErrTruncated) {
+				rep.Truncated = true
+			}
+			addIssue(&rep.Errors, &rep.ErrorCount, opts.maxIssues,
+				verifyIssue{Record: rep.Records, Error: err.Error()})
+			continue
+		}
+		lastErr = ""
+
+		ts, err := it.TimestampE()
+		if err != nil {
+			addIssue(&rep.Errors, &rep.ErrorCount, opts.maxIssues,
+				verifyIssue{Record: rep.Records, Error: err.Error()})
+			rep.Records++
+			continue
+		}
+
+		switch {
+		case prev == nil:
+			rep.First = &ts
+		case ts.Before(*prev):
+			addIssue(&rep.OutOfOrder, &rep.OutOfOrderCount, opts.maxIssues,
+				verifyIssue{Record: rep.Records, TS: &ts, Previous: prev})
+		case opts.maxGap > 0 && ts.Sub(*prev) > opts.maxGap:
+			addIssue(&rep.Gaps, &rep.GapCount, opts.maxIssues,
+				verifyIssue{Record: rep.Records, TS: &ts, Previous: prev,
+					Duration: ts.Sub(*prev).String()})
+		}
+		if prev == nil || !ts.Before(*prev) {
+			t := ts
+			prev = &t
+			rep.Last = &t
+		}
+		rep.Records++
+	}
+	return rep
+}
+
+// statcap verify [flags] capture...
+//
+// Prints a JSON report and returns the exit status: 0 if every
+// capture checked out, 1 if any didn't, 2 for bad usage.
+func verifyMain(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	interval := fs.Duration("interval", 5*time.Second,
+		"Expected time between samples (statcap's -sleep)")
+	maxGap := fs.Duration("maxgap", 0,
+		"Longest allowed time between records (default 2x -interval; <0 to skip)")
+	maxIssues := fs.Int("max", 20, "Most issues of each kind to list per capture")
+	pretty := fs.Bool("pretty", false, "Indent the report")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: statcap verify [flags] capture...\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	opts := verifyOptions{maxGap: *maxGap, maxIssues: *maxIssues}
+	if opts.maxGap == 0 {
+		opts.maxGap = 2 * *interval
+	}
+
+	report := struct {
+		OK       bool           `json:"ok"`
+		Captures []verifyReport `json:"captures"`
+	}{OK: true}
+	for _, path := range fs.Args() {
+		rep := verifyCapture(path, opts)
+		report.OK = report.OK && rep.OK
+		report.Captures = append(report.Captures, rep)
+	}
+
+	e := json.NewEncoder(out)
+	if *pretty {
+		e.SetIndent("", "  ")
+	}
+	e.Encode(report)
+
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dustin/statcap/statstore"
+)
+
+// Write a capture with items at the given offsets (in seconds) from
+// basetime.
+func writeCapture(t *testing.T, filename string, secs ...int) {
+	fs, err := statstore.GetStorer(filename)
+	if err != nil {
+		t.Fatalf("Error opening %v: %v", filename, err)
+	}
+	defer fs.Close()
+	for _, s := range secs {
+		_, _, err := fs.Insert(statstore.NewItem(map[string]interface{}{"s": s},
+			basetime.Add(time.Duration(s)*time.Second)))
+		if err != nil {
+			t.Fatalf("Error storing item: %v", err)
+		}
+	}
+}
+
+type testVerifyReport struct {
+	OK       bool
+	Captures []verifyReport
+}
+
+func runVerify(t *testing.T, args ...string) (int, testVerifyReport) {
+	out := &bytes.Buffer{}
+	rv := verifyMain(args, out)
+	rep := testVerifyReport{}
+	if rv != 2 {
+		if err := json.Unmarshal(out.Bytes(), &rep); err != nil {
+			t.Fatalf("Error decoding report %q: %v", out, err)
+		}
+	}
+	return rv, rep
+}
+
+func TestVerify(t *testing.T) {
+	files := []string{"testverify-good.gz", "testverify-good.zip",
+		"testverify-order.gz", "testverify-gap.gz", "testverify-corrupt.gz",
+		"testverify-truncated.gz"}
+	for _, f := range files {
+		defer os.Remove(f)
+	}
+	writeCapture(t, "testverify-good.gz", 0, 5, 10, 15)
+	writeCapture(t, "testverify-good.zip", 0, 5, 10, 15)
+	writeCapture(t, "testverify-order.gz", 0, 5, 3, 10)
+	writeCapture(t, "testverify-gap.gz", 0, 5, 60, 65)
+	writeCapture(t, "testverify-corrupt.gz", 0, 5, 10)
+	writeCapture(t, "testverify-truncated.gz", 0, 5, 10)
+
+	data, _ := os.ReadFile("testverify-corrupt.gz")
+	// The CRC in the gzip trailer.
+	data[len(data)-6] ^= 0xff
+	os.WriteFile("testverify-corrupt.gz", data, 0666)
+
+	data, _ = os.ReadFile("testverify-truncated.gz")
+	os.WriteFile("testverify-truncated.gz", data[:len(data)-4], 0666)
+
+	rv, rep := runVerify(t, "testverify-good.gz", "testverify-good.zip")
+	if rv != 0 || !rep.OK || len(rep.Captures) != 2 {
+		t.Fatalf("Expected good captures to verify, got %v: %+v", rv, rep)
+	}
+	for _, c := range rep.Captures {
+		if c.Records != 4 || !c.First.Equal(basetime) ||
+			!c.Last.Equal(basetime.Add(15*time.Second)) {
+			t.Fatalf("Wrong summary: %+v", c)
+		}
+	}
+
+	tests := []struct {
+		path  string
+		check func(verifyReport) bool
+	}{
+		{"testverify-order.gz", func(r verifyReport) bool {
+			return r.OutOfOrderCount == 1 && r.OutOfOrder[0].Record == 2
+		}},
+		{"testverify-gap.gz", func(r verifyReport) bool {
+			return r.GapCount == 1 && r.Gaps[0].Duration == "55s"
+		}},
+		{"testverify-corrupt.gz", func(r verifyReport) bool {
+			return r.ErrorCount == 1 && r.Records == 3
+		}},
+		{"testverify-truncated.gz", func(r verifyReport) bool {
+			return r.ErrorCount == 1 && r.Truncated
+		}},
+		{"testverify-missing.gz", func(r verifyReport) bool {
+			return r.ErrorCount == 1
+		}},
+	}
+	for _, test := range tests {
+		rv, rep := runVerify(t, test.path)
+		if rv != 1 || rep.OK || rep.Captures[0].OK ||
+			!test.check(rep.Captures[0]) {
+			t.Errorf("%v: unexpected report (%v): %+v", test.path, rv, rep)
+		}
+	}
+
+	// Gaps can be allowed for.
+	if rv, _ := runVerify(t, "-maxgap=1m", "testverify-gap.gz"); rv != 0 {
+		t.Errorf("Expected a gap under -maxgap to be fine, got %v", rv)
+	}
+	if rv, _ := runVerify(t); rv != 2 {
+		t.Errorf("Expected usage error, got %v", rv)
+	}
+}